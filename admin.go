@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/duego/cryriver/elasticsearch"
+	"github.com/duego/cryriver/mongodb"
+	"github.com/duego/cryriver/stats"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requireToken only lets requests with the token as bearer through, anything goes with an empty token.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON responds with v as json.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// postOnly responds 405 unless the request is a POST, returning false.
+func postOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// poolHandler shows the size of the slurper pool, a POST with a size resizes it within its bounds.
+func poolHandler(pool *elasticsearch.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			size, err := strconv.Atoi(r.FormValue("size"))
+			if err != nil {
+				http.Error(w, "Invalid size: "+r.FormValue("size"), http.StatusBadRequest)
+				return
+			}
+			pool.Resize(size)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		min, max := pool.Bounds()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"size":       pool.Size(),
+			"min":        min,
+			"max":        max,
+			"latency_ms": int64(pool.Latency() / time.Millisecond),
+		})
+	}
+}
+
+// pauser holds the tailer while paused, Tail then blocks handing over its next operation, keeping its
+// cursor open.
+type pauser struct {
+	mu      sync.Mutex
+	resumed chan bool // Closed while not paused
+}
+
+func newPauser() *pauser {
+	p := &pauser{resumed: make(chan bool)}
+	close(p.resumed)
+	return p
+}
+
+func (p *pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		p.resumed = make(chan bool)
+	default:
+	}
+}
+
+func (p *pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+	default:
+		close(p.resumed)
+	}
+}
+
+func (p *pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// Resumed returns a channel that is closed once not paused.
+func (p *pauser) Resumed() <-chan bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// The timestamp of the last operation handed to the slurpers.
+var lastDispatched int64
+
+// position is an oplog timestamp as shown by the admin API.
+type position struct {
+	Ts      int64     `json:"ts"`
+	Time    time.Time `json:"time"`
+	Ordinal int32     `json:"ordinal"`
+}
+
+func newPosition(ts mongodb.Timestamp) *position {
+	if ts == 0 {
+		return nil
+	}
+	return &position{int64(ts), *ts.Time(), ts.Ordinal()}
+}
+
+type namespaceStatus struct {
+	Phase         string    `json:"phase"`
+	Dispatched    *position `json:"dispatched,omitempty"`
+	Acknowledged  *position `json:"acknowledged,omitempty"`
+	Checkpoint    *position `json:"checkpoint,omitempty"`
+	LagSeconds    *float64  `json:"lag_seconds,omitempty"`
+	LagOperations *int      `json:"lag_operations,omitempty"`
+}
+
+type status struct {
+	Paused     bool                       `json:"paused"`
+	Namespaces map[string]namespaceStatus `json:"namespaces"`
+	Queues     map[string]int             `json:"queues"`
+	Nodes      []elasticsearch.NodeStatus `json:"nodes"`
+}
+
+// admin serves the admin API on the debug address.
+type admin struct {
+	ns      string
+	pause   *pauser
+	flusher *elasticsearch.Flusher
+	client  *elasticsearch.Client
+	health  *health
+	queues  func() map[string]int
+	rewinds chan<- rewind
+	stopped <-chan struct{} // Closed once the river stops reading
+}
+
+// register adds the admin endpoints to mux, protected by the token.
+func (a *admin) register(mux *http.ServeMux, token string) {
+	mux.Handle("/admin/status", requireToken(token, http.HandlerFunc(a.status)))
+	mux.Handle("/admin/pause", requireToken(token, http.HandlerFunc(a.pauseHandler)))
+	mux.Handle("/admin/resume", requireToken(token, http.HandlerFunc(a.resumeHandler)))
+	mux.Handle("/admin/flush", requireToken(token, http.HandlerFunc(a.flush)))
+	mux.Handle("/admin/checkpoint", requireToken(token, http.HandlerFunc(a.checkpoint)))
+	mux.Handle("/admin/rewind", requireToken(token, http.HandlerFunc(a.rewind)))
+	mux.Handle("/admin/skip", requireToken(token, http.HandlerFunc(a.skip)))
+}
+
+func (a *admin) currentStatus() status {
+	phase := stats.Phase.Value()
+	if phase == "" {
+		phase = "starting"
+	}
+	ns := namespaceStatus{
+		Phase:        phase,
+		Dispatched:   newPosition(mongodb.Timestamp(atomic.LoadInt64(&lastDispatched))),
+		Acknowledged: newPosition(progress.Acked()),
+		Checkpoint:   newPosition(mongodb.Timestamp(atomic.LoadInt64(&lastSaved))),
+	}
+	if lag, ops, ok := a.health.Lag(); ok {
+		seconds := lag.Seconds()
+		ns.LagSeconds = &seconds
+		ns.LagOperations = &ops
+	}
+	return status{
+		Paused:     a.pause.Paused(),
+		Namespaces: map[string]namespaceStatus{a.ns: ns},
+		Queues:     a.queues(),
+		Nodes:      a.client.Nodes(),
+	}
+}
+
+// status shows where the river is, how much is queued and how elasticsearch nodes are doing.
+func (a *admin) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.currentStatus())
+}
+
+// pauseHandler stops handing operations to the slurpers until resumed.
+func (a *admin) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	a.pause.Pause()
+	writeJSON(w, http.StatusOK, a.currentStatus())
+}
+
+func (a *admin) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	a.pause.Resume()
+	writeJSON(w, http.StatusOK, a.currentStatus())
+}
+
+// flush makes all slurpers send what they have collected, without waiting for the requests.
+func (a *admin) flush(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	a.flusher.Flush()
+	writeJSON(w, http.StatusAccepted, map[string]string{"flush": "started"})
+}
+
+// checkpoint saves progress right away.
+func (a *admin) checkpoint(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	ts, err := checkpoint(r.Context())
+	if err != nil {
+		http.Error(w, "Could not save checkpoint: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]*position{"checkpoint": newPosition(ts)})
+}
+
+// rewind tails from after the timestamp given as ts, either as saved in the progress file or as a time
+// like 2014-02-25T10:46:24Z. A skip drops that many operations after it.
+func (a *admin) rewind(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	ts, err := mongodb.ParseTimestamp(r.FormValue("ts"))
+	if err == nil && ts == 0 {
+		err = errors.New("Rewinding to 0 would start an initial import, use -initial for that")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var skip int
+	if s := r.FormValue("skip"); s != "" {
+		if skip, err = strconv.Atoi(s); err != nil || skip < 0 {
+			http.Error(w, "Invalid skip: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	a.restart(w, r, rewind{ts: ts, skip: skip})
+}
+
+// skip drops the next n operations after the last one handed to the slurpers.
+func (a *admin) skip(w http.ResponseWriter, r *http.Request) {
+	if !postOnly(w, r) {
+		return
+	}
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n < 1 {
+		http.Error(w, "Invalid n: "+r.FormValue("n"), http.StatusBadRequest)
+		return
+	}
+	a.restart(w, r, rewind{skip: n})
+}
+
+// restart has the dispatcher restart tailing and responds with the status afterwards.
+func (a *admin) restart(w http.ResponseWriter, r *http.Request, rw rewind) {
+	rw.done = make(chan error, 1)
+	select {
+	case a.rewinds <- rw:
+	case <-a.stopped:
+		http.Error(w, ShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if err := <-rw.done; err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.currentStatus())
+}
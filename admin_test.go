@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/duego/cryriver/elasticsearch"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauser(t *testing.T) {
+	p := newPauser()
+	if p.Paused() {
+		t.Error("Expected a new pauser not to be paused")
+	}
+	p.Pause()
+	p.Pause()
+	resumed := p.Resumed()
+	select {
+	case <-resumed:
+		t.Fatal("Expected Resumed to block while paused")
+	default:
+	}
+	if !p.Paused() {
+		t.Error("Expected the pauser to be paused")
+	}
+	p.Resume()
+	p.Resume()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Resumed to be closed once resumed")
+	}
+	if p.Paused() {
+		t.Error("Expected the pauser to be resumed")
+	}
+}
+
+// newTestAdmin serves the admin API with the token, stopped tells if the river has stopped reading.
+func newTestAdmin(token string, rewinds chan<- rewind, stopped bool) (*admin, *httptest.Server) {
+	stop := make(chan struct{})
+	if stopped {
+		close(stop)
+	}
+	a := &admin{
+		ns:      "test.users",
+		pause:   newPauser(),
+		rewinds: rewinds,
+		stopped: stop,
+		flusher: elasticsearch.NewFlusher(),
+		client:  elasticsearch.NewClient([]string{"http://127.0.0.1:9200"}, 1),
+		health:  newHealth(0, 0, 0, slog.Default()),
+		queues:  func() map[string]int { return map[string]int{} },
+	}
+	mux := http.NewServeMux()
+	a.register(mux, token)
+	return a, httptest.NewServer(mux)
+}
+
+func adminRequest(t *testing.T, method, target, token string, form url.Values) *http.Response {
+	req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAdminToken(t *testing.T) {
+	_, server := newTestAdmin("secret", nil, false)
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		resp := adminRequest(t, "GET", server.URL+"/admin/status", token, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Error("Expected", token, "to be unauthorized, got", resp.Status)
+		}
+	}
+	resp := adminRequest(t, "GET", server.URL+"/admin/status", "secret", nil)
+	defer resp.Body.Close()
+	var s status
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the status, got", resp.Status, err)
+	}
+	if _, ok := s.Namespaces["test.users"]; !ok || len(s.Nodes) != 1 {
+		t.Error("Expected the namespace and node in the status, got", s)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	a, server := newTestAdmin("", nil, false)
+	defer server.Close()
+
+	resp := adminRequest(t, "GET", server.URL+"/admin/pause", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Expected GET to not be allowed, got", resp.Status)
+	}
+
+	for _, test := range []struct {
+		path   string
+		paused bool
+	}{
+		{"/admin/pause", true},
+		{"/admin/resume", false},
+	} {
+		resp := adminRequest(t, "POST", server.URL+test.path, "", nil)
+		var s status
+		err := json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal(test.path, "failed:", resp.Status, err)
+		}
+		if s.Paused != test.paused || a.pause.Paused() != test.paused {
+			t.Error(test.path, "expected paused to be", test.paused)
+		}
+	}
+}
+
+func TestAdminRewindInvalid(t *testing.T) {
+	_, server := newTestAdmin("", nil, false)
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		form url.Values
+	}{
+		{"/admin/rewind", url.Values{"ts": {"yesterday"}}},
+		{"/admin/rewind", url.Values{"ts": {"0"}}},
+		{"/admin/rewind", url.Values{"ts": {"5"}, "skip": {"-1"}}},
+		{"/admin/skip", url.Values{"n": {"0"}}},
+	} {
+		resp := adminRequest(t, "POST", server.URL+test.path, "", test.form)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error(test.path, test.form, "expected to be a bad request, got", resp.Status)
+		}
+	}
+}
+
+func TestAdminRewindStopped(t *testing.T) {
+	_, server := newTestAdmin("", make(chan rewind), true)
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		form url.Values
+	}{
+		{"/admin/rewind", url.Values{"ts": {"5"}}},
+		{"/admin/skip", url.Values{"n": {"1"}}},
+	} {
+		resp := adminRequest(t, "POST", server.URL+test.path, "", test.form)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Error(test.path, "expected to be refused once stopped, got", resp.Status)
+		}
+	}
+}
+
+func TestAdminRewindTailStopped(t *testing.T) {
+	tail := newTailer(nil, "test.users", newPauser(), slog.Default())
+	close(tail.done)
+	// Stands in for the dispatcher, which applies rewinds between operations.
+	rewinds := make(chan rewind)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case r := <-rewinds:
+				r.done <- r.apply(ctx, tail)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	_, server := newTestAdmin("", rewinds, false)
+	defer server.Close()
+
+	resp := adminRequest(t, "POST", server.URL+"/admin/rewind", "", url.Values{"ts": {"5"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Expected rewinding a stopped tailer to fail, got", resp.Status)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/duego/cryriver/mongodb"
+	"github.com/duego/cryriver/script"
+	"os"
+)
+
+// Config is read from the file given by -config and holds settings for each namespace.
+type Config struct {
+	Namespaces map[string]*NamespaceConfig `json:"namespaces"`
+}
+
+// NamespaceConfig holds the settings for one database.collection.
+type NamespaceConfig struct {
+	// Delete replaces the default soft delete rule, an empty field disables soft deletes.
+	Delete *mongodb.DeleteRule `json:"delete"`
+
+	// Include and Exclude lists which fields to send to ES.
+	mongodb.Projection
+
+	// Rules are applied to every document before it is sent to ES.
+	Rules mongodb.Rules `json:"rules"`
+
+	// Routing is the field whose value is used for routing documents to ES shards.
+	Routing string `json:"routing"`
+
+	// Script is the path of a Starlark file with a transform function, run after Rules.
+	Script string `json:"script"`
+}
+
+// loadConfig reads a json config file, an empty path returns an empty config.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{Namespaces: make(map[string]*NamespaceConfig)}
+	if path == "" {
+		return config, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return nil, err
+	}
+	for ns, nsConfig := range config.Namespaces {
+		if err := nsConfig.Rules.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", ns, err)
+		}
+	}
+	return config, nil
+}
+
+// apply registers the configured rules with the mongodb package. Scripts still running when ctx is
+// done are cancelled.
+func (c *Config) apply(ctx context.Context) error {
+	for ns, nsConfig := range c.Namespaces {
+		if nsConfig.Delete != nil {
+			mongodb.DeleteRules[ns] = nsConfig.Delete
+		}
+		if len(nsConfig.Include) > 0 || len(nsConfig.Exclude) > 0 {
+			mongodb.Projections[ns] = &nsConfig.Projection
+		}
+		if len(nsConfig.Rules) > 0 {
+			mongodb.NamespaceManipulators[ns] = append(mongodb.NamespaceManipulators[ns], nsConfig.Rules)
+		}
+		if nsConfig.Routing != "" {
+			mongodb.Routings[ns] = nsConfig.Routing
+		}
+		if nsConfig.Script != "" {
+			s, err := script.Load(ctx, nsConfig.Script, ns)
+			if err != nil {
+				return err
+			}
+			mongodb.NamespaceManipulators[ns] = append(mongodb.NamespaceManipulators[ns], s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/duego/cryriver/stats"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a node is considered dead after its first failure, doubled for each failure in a row.
+	deadBackoff = time.Second
+	// The longest a node is considered dead before it's tried again.
+	maxDeadBackoff = time.Minute
+)
+
+// NoNodesAvailable is returned when a request could not be sent to any of the nodes.
+var NoNodesAvailable = errors.New("No elasticsearch nodes available")
+
+// node is one elasticsearch http endpoint.
+type node struct {
+	url       string
+	failures  uint
+	deadUntil time.Time
+}
+
+func (n *node) alive(now time.Time) bool {
+	return !now.Before(n.deadUntil)
+}
+
+// Client is used for sending the actual requests to elasticsearch. Requests are spread over all nodes
+// in a round-robin fashion, nodes failing to respond are skipped until their backoff has passed.
+type Client struct {
+	*http.Client
+
+	// Credentials, if set, are added to every request.
+	Credentials *Credentials
+
+	// Logger for node failures and requests, slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Compresses request bodies when set.
+	gzip *compressor
+
+	mu    sync.Mutex
+	nodes []*node
+	next  int
+}
+
+// NewClient returns a client for the nodes given by their base url, e.g. http://localhost:9200.
+func NewClient(urls []string, maxConn int) *Client {
+	tr := &http.Transport{
+		MaxIdleConnsPerHost: maxConn,
+	}
+	c := &Client{Client: &http.Client{Transport: tr}}
+	c.setNodes(urls)
+	return c
+}
+
+// setNodes replaces the nodes, keeping the state of nodes already known.
+func (c *Client) setNodes(urls []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	known := make(map[string]*node, len(c.nodes))
+	for _, n := range c.nodes {
+		known[n.url] = n
+	}
+	nodes := make([]*node, 0, len(urls))
+	for _, url := range urls {
+		url = strings.TrimRight(url, "/")
+		if n, ok := known[url]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &node{url: url})
+		}
+	}
+	c.nodes = nodes
+}
+
+// pick returns the next live node. If all nodes are dead the one closest to being retried is used.
+func (c *Client) pick() *node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.nodes) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var soonest *node
+	for i := 0; i < len(c.nodes); i++ {
+		n := c.nodes[(c.next+i)%len(c.nodes)]
+		if n.alive(now) {
+			c.next = (c.next + i + 1) % len(c.nodes)
+			return n
+		}
+		if soonest == nil || n.deadUntil.Before(soonest.deadUntil) {
+			soonest = n
+		}
+	}
+	return soonest
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
+// markDead puts the node on hold with an exponential backoff.
+func (c *Client) markDead(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	backoff := deadBackoff << n.failures
+	if backoff > maxDeadBackoff || backoff <= 0 {
+		backoff = maxDeadBackoff
+	} else {
+		n.failures++
+	}
+	n.deadUntil = time.Now().Add(backoff)
+	c.logger().Warn("Marking elasticsearch node dead", "node", n.url, "backoff", backoff)
+}
+
+func (c *Client) markAlive(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n.failures = 0
+	n.deadUntil = time.Time{}
+}
+
+// NodeStatus is how the client sees one elasticsearch node.
+type NodeStatus struct {
+	URL       string     `json:"url"`
+	Alive     bool       `json:"alive"`
+	Failures  uint       `json:"failures"`
+	DeadUntil *time.Time `json:"dead_until,omitempty"`
+}
+
+// Nodes returns the status of the nodes requests are sent to.
+func (c *Client) Nodes() []NodeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	nodes := make([]NodeStatus, len(c.nodes))
+	for i, n := range c.nodes {
+		nodes[i] = NodeStatus{URL: n.url, Alive: n.alive(now), Failures: n.failures}
+		if !nodes[i].Alive {
+			deadUntil := n.deadUntil
+			nodes[i].DeadUntil = &deadUntil
+		}
+	}
+	return nodes
+}
+
+// Do sends a request to the given path, failing over to the next node when a node can't be reached
+// or responds that it's unavailable. The body is sent again for every node tried and may be reused
+// once Do returns. Nodes aren't failed over once ctx is done, Timeout limits each node tried.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	c.mu.Lock()
+	attempts := len(c.nodes)
+	c.mu.Unlock()
+
+	var encoding string
+	if c.gzip != nil && len(body) > 0 {
+		buf, err := c.gzip.compress(body)
+		if err != nil {
+			return nil, err
+		}
+		defer c.gzip.release(buf)
+		body = buf.Bytes()
+		encoding = "gzip"
+	}
+
+	err := NoNodesAvailable
+	for i := 0; i < attempts; i++ {
+		n := c.pick()
+		var reqBody *trackedBody
+		var req *http.Request
+		if len(body) > 0 {
+			reqBody = newTrackedBody(body)
+			req, err = http.NewRequestWithContext(ctx, method, n.url+path, reqBody)
+		} else {
+			req, err = http.NewRequestWithContext(ctx, method, n.url+path, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		c.Credentials.apply(req)
+		var resp *http.Response
+		resp, err = c.Client.Do(req)
+		// The transport may still be reading the body when the response arrives.
+		reqBody.wait()
+		if err == nil && !unavailable(resp.StatusCode) {
+			c.markAlive(n)
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("Node %s responded with status code: %d", n.url, resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// The node isn't to blame for requests that were cancelled.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.markDead(n)
+	}
+	return nil, err
+}
+
+// trackedBody is a request body that lets us know when the transport is done with it, so that the
+// bytes can be reused.
+type trackedBody struct {
+	*bytes.Reader
+	once   sync.Once
+	closed chan bool
+}
+
+func newTrackedBody(b []byte) *trackedBody {
+	return &trackedBody{Reader: bytes.NewReader(b), closed: make(chan bool)}
+}
+
+func (t *trackedBody) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// wait blocks until the body is closed, a nil body is never waited for.
+func (t *trackedBody) wait() {
+	if t != nil {
+		<-t.closed
+	}
+}
+
+// unavailable reports whether the status code means the node can't serve requests right now.
+func unavailable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// Ping checks that the cluster responds.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.Do(ctx, "GET", "/", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sniff replaces the nodes with the http addresses of all nodes in the cluster, as listed by
+// _nodes/http on any of the current nodes.
+func (c *Client) Sniff(ctx context.Context) error {
+	resp, err := c.Do(ctx, "GET", "/_nodes/http", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code sniffing nodes: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Nodes map[string]struct {
+			Http struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+			HttpAddress string `json:"http_address"`
+		} `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if n := c.pick(); n != nil && strings.HasPrefix(n.url, "https://") {
+		scheme = "https"
+	}
+	urls := make([]string, 0, len(info.Nodes))
+	for _, n := range info.Nodes {
+		address := n.Http.PublishAddress
+		if address == "" {
+			address = n.HttpAddress
+		}
+		if address = sniffedAddress(address); address != "" {
+			urls = append(urls, scheme+"://"+address)
+		}
+	}
+	if len(urls) == 0 {
+		return errors.New("Sniffing found no nodes with http enabled")
+	}
+	c.setNodes(urls)
+	return nil
+}
+
+// sniffedAddress cleans up the different address formats used by elasticsearch versions:
+// "inet[/10.0.0.1:9200]", "hostname/10.0.0.1:9200" and "10.0.0.1:9200".
+func sniffedAddress(address string) string {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "inet["), "]")
+	if i := strings.LastIndex(address, "/"); i >= 0 {
+		address = address[i+1:]
+	}
+	return address
+}
+
+// SniffEvery sniffs for nodes on an interval until ctx is done.
+func (c *Client) SniffEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Sniff(ctx); err != nil {
+				c.logger().Warn("Sniffing elasticsearch nodes failed", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// BulkSend will accept a populated BulkBody that will be sent using POST.
+// The BulkBody is Reset to accept new operations once elasticsearch has answered with the result of
+// every entry, unless it rejected some of them for being too busy, then Rejected is returned and only
+// the rejected entries are left in the BulkBody. It is also Reset when elasticsearch refused the whole
+// request with a 4xx status, see RequestFailed. On other errors, such as a failed connection, a 5xx
+// status or a request cancelled through ctx, the whole BulkBody is kept to be sent again.
+func (c *Client) BulkSend(ctx context.Context, b *BulkBody) error {
+	b.Done()
+	c.logger().Debug("Sending bulk request", "entries", b.Entries(), "bytes", b.Len())
+	stats.BulkBytes.Observe(float64(b.Len()))
+	start := time.Now()
+	result, err := c.bulkSend(ctx, b)
+	stats.BulkDuration.Observe(time.Since(start).Seconds(), result)
+	return err
+}
+
+// bulkSend does the request for BulkSend, the result is one of ok, failed, rejected or error.
+func (c *Client) bulkSend(ctx context.Context, b *BulkBody) (string, error) {
+	resp, err := c.Do(ctx, "POST", "/_bulk", "application/x-ndjson", b.Bytes())
+	if err != nil {
+		return "error", err
+	}
+	defer resp.Body.Close()
+
+	switch code := resp.StatusCode; code {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		io.Copy(ioutil.Discard, resp.Body)
+		return "rejected", Rejected{Entries: b.Entries()}
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		if code >= 500 {
+			return "error", errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(body)))
+		}
+		// Elasticsearch won't take the request as it is, sending it again would fail the same way.
+		err := RequestFailed{code, string(body)}
+		for n := 0; n < b.Entries(); n++ {
+			b.acknowledge(n, err)
+		}
+		stats.BulkItemFailures.Add(float64(b.Entries()), "status_"+strconv.Itoa(code))
+		b.Reset()
+		return "failed", err
+	}
+
+	// The request as a whole can succeed while single items fail.
+	var response BulkResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return "error", err
+	}
+	failed := response.Failed(b.Options.ExternalVersion)
+	response.acknowledge(b, b.Options.ExternalVersion)
+	for _, item := range failed {
+		reason := "status_" + strconv.Itoa(item.Status)
+		if item.Error != nil {
+			reason = item.Error.Type
+		}
+		stats.BulkItemFailures.Inc(reason)
+	}
+	if rejected := response.Rejected(); len(rejected) > 0 {
+		b.Retain(rejected)
+		return "rejected", Rejected{len(rejected), failed}
+	}
+	b.Reset()
+	if len(failed) > 0 {
+		return "failed", BulkItemsFailed{failed}
+	}
+	return "ok", nil
+}
@@ -0,0 +1,162 @@
+package elasticsearch
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientRoundRobin(t *testing.T) {
+	hits := make(map[string]int)
+	var servers []*httptest.Server
+	for _, name := range []string{"a", "b"} {
+		name := name
+		servers = append(servers, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[name]++
+		})))
+	}
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	c := NewClient([]string{servers[0].URL, servers[1].URL + "/"}, 1)
+	for i := 0; i < 4; i++ {
+		resp, err := c.Do(context.Background(), "GET", "/", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if hits["a"] != 2 || hits["b"] != 2 {
+		t.Error("Expected requests to be spread evenly, got", hits)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	var bodies []string
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, r.ContentLength)
+		r.Body.Read(b)
+		bodies = append(bodies, string(b))
+	}))
+	defer alive.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	c := NewClient([]string{down.URL, unavailable.URL, alive.URL}, 1)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Do(context.Background(), "POST", "/_bulk", "", []byte("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(bodies) != 3 || bodies[0] != "body" {
+		t.Error("Expected all requests to reach the live node with their body, got", bodies)
+	}
+	for _, n := range c.nodes[:2] {
+		if n.alive(time.Now()) {
+			t.Error("Expected node to be marked dead:", n.url)
+		}
+	}
+	if !c.nodes[2].alive(time.Now()) {
+		t.Error("Expected node to be alive:", c.nodes[2].url)
+	}
+}
+
+func TestClientAllDead(t *testing.T) {
+	down := httptest.NewServer(nil)
+	down.Close()
+	c := NewClient([]string{down.URL}, 1)
+	if _, err := c.Do(context.Background(), "GET", "/", "", nil); err == nil {
+		t.Error("Expected an error when no node is reachable")
+	}
+	if c.nodes[0].failures != 1 {
+		t.Error("Expected one failure, got", c.nodes[0].failures)
+	}
+	if nodes := c.Nodes(); len(nodes) != 1 || nodes[0].Alive || nodes[0].DeadUntil == nil {
+		t.Error("Expected the node to be reported dead, got", nodes)
+	}
+}
+
+func TestClientSniff(t *testing.T) {
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_nodes/http" {
+			t.Error("Unexpected sniff path", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"nodes": {
+			"a": {"http": {"publish_address": "10.0.0.1:9200"}},
+			"b": {"http": {"publish_address": "es2.local/10.0.0.2:9200"}},
+			"c": {"http_address": "inet[/10.0.0.3:9200]"}
+		}}`)
+	}))
+	defer seed.Close()
+
+	c := NewClient([]string{seed.URL}, 1)
+	if err := c.Sniff(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, n := range c.nodes {
+		urls = append(urls, n.url)
+	}
+	for _, url := range []string{"http://10.0.0.1:9200", "http://10.0.0.2:9200", "http://10.0.0.3:9200"} {
+		if !strings.Contains(strings.Join(urls, " "), url) {
+			t.Error("Expected to find", url, "in", urls)
+		}
+	}
+}
+
+func TestClientGzip(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := r.Header.Get("Content-Encoding"); e != "gzip" {
+			t.Error("Expected gzip encoding, got", e)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Error("Expected ndjson content type, got", ct)
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, string(b))
+		fmt.Fprint(w, `{"took": 1, "errors": false, "items": []}`)
+	}))
+	defer server.Close()
+
+	c := NewClient([]string{server.URL}, 1)
+	if err := c.SetGzip(42); err == nil {
+		t.Error("Expected an invalid level to fail")
+	}
+	if err := c.SetGzip(gzip.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+
+	bulk := NewBulkBody(MB)
+	for _, alias := range []string{"Johnny", "Bobby"} {
+		if err := bulk.Add(&rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": alias}}); err != nil {
+			t.Fatal(err)
+		}
+		valid := bulk.String() + "\n"
+		if err := c.BulkSend(context.Background(), bulk); err != nil {
+			t.Fatal(err)
+		}
+		if last := received[len(received)-1]; last != valid {
+			t.Errorf("\n'%s'\nNot equal to:\n'%s'", last, valid)
+		}
+	}
+}
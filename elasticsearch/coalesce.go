@@ -0,0 +1,173 @@
+package elasticsearch
+
+import (
+	"context"
+	"strings"
+)
+
+// Coalescer collects transactions and merges the ones on the same document, so that a burst of
+// changes is sent as one bulk entry:
+//
+//	update + update  becomes one update with the documents merged
+//	index + update   becomes one index with the update applied
+//	delete + update  becomes an index of the update, as updates upsert
+//	any + index      becomes the index
+//	any + delete     becomes the delete
+//
+// The merged transaction keeps the timestamp, and the trace span, of the last one. Acknowledging it
+// acknowledges all the transactions merged into it. Updates are not
+// merged when a field of one is within a field of the other, such as "profile" and "profile.city",
+// as the order of the two would be lost. They are sent as separate entries instead.
+type Coalescer struct {
+	order   []*merged
+	pending map[coalesceKey]*merged
+}
+
+type coalesceKey struct {
+	index, id string
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{pending: make(map[coalesceKey]*merged)}
+}
+
+// Len returns the number of transactions waiting to be drained.
+func (c *Coalescer) Len() int {
+	return len(c.order)
+}
+
+// Add merges the transaction with any pending one for the same document.
+func (c *Coalescer) Add(t Transaction) error {
+	index, err := t.Index()
+	if err != nil {
+		return err
+	}
+	id, err := t.Id()
+	if err != nil {
+		return err
+	}
+	action, err := t.Action()
+	if err != nil {
+		return err
+	}
+	doc, err := t.Document()
+	if err != nil {
+		return err
+	}
+
+	key := coalesceKey{index, id}
+	prev, ok := c.pending[key]
+	if !ok || (action == "update" && prev.action != "delete" && overlaps(prev.doc, doc)) {
+		m := &merged{Transaction: t, action: action, doc: doc}
+		m.add(t)
+		c.pending[key] = m
+		c.order = append(c.order, m)
+		return nil
+	}
+
+	switch {
+	case action == "update" && (prev.action == "update" || prev.action == "index"):
+		prev.doc = mergeDocuments(prev.doc, doc)
+	case action == "update" && prev.action == "delete":
+		prev.action, prev.doc = "index", doc
+	default:
+		prev.action, prev.doc = action, doc
+	}
+	prev.Transaction = t
+	prev.add(t)
+	return nil
+}
+
+// Drain returns the pending transactions in the order they were first added, which keeps the order
+// of the changes to each document, and empties the Coalescer.
+func (c *Coalescer) Drain() []Transaction {
+	ts := make([]Transaction, len(c.order))
+	for i, m := range c.order {
+		if _, ok := m.Transaction.(Versioner); ok {
+			ts[i] = versioned{m}
+		} else {
+			ts[i] = m
+		}
+	}
+	c.order = c.order[:0]
+	c.pending = make(map[coalesceKey]*merged)
+	return ts
+}
+
+// overlaps reports whether a field of changes is within a field of doc or the other way around. The
+// same field in both is not an overlap, the change replaces it.
+func overlaps(doc, changes map[string]interface{}) bool {
+	for k := range changes {
+		for d := range doc {
+			if strings.HasPrefix(k, d+".") || strings.HasPrefix(d, k+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeDocuments returns a new document with the changes applied on top of the original.
+func mergeDocuments(doc, changes map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(doc)+len(changes))
+	for k, v := range doc {
+		m[k] = v
+	}
+	for k, v := range changes {
+		m[k] = v
+	}
+	return m
+}
+
+// merged is the result of coalescing, identified by the last transaction merged into it.
+type merged struct {
+	Transaction
+	action string
+	doc    map[string]interface{}
+	acks   []Acknowledger
+}
+
+// add keeps t to be acknowledged along with the merged transaction.
+func (m *merged) add(t Transaction) {
+	if a, ok := t.(Acknowledger); ok {
+		m.acks = append(m.acks, a)
+	}
+}
+
+func (m *merged) Acknowledge(err error) {
+	for _, a := range m.acks {
+		a.Acknowledge(err)
+	}
+}
+
+func (m *merged) Action() (string, error) {
+	return m.action, nil
+}
+
+func (m *merged) Document() (map[string]interface{}, error) {
+	return m.doc, nil
+}
+
+func (m *merged) Routing() (string, error) {
+	if r, ok := m.Transaction.(Router); ok {
+		return r.Routing()
+	}
+	return "", nil
+}
+
+func (m *merged) Context() context.Context {
+	if c, ok := m.Transaction.(Contexter); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// versioned is a merged transaction versioned by its last transaction, merged ones are only
+// Versioners if that one is.
+type versioned struct {
+	*merged
+}
+
+func (v versioned) Version() (int64, error) {
+	return v.Transaction.(Versioner).Version()
+}
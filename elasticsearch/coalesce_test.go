@@ -0,0 +1,185 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type timedEntry struct {
+	rawEntry
+	ts time.Time
+}
+
+func (e *timedEntry) Time() *time.Time {
+	return &e.ts
+}
+
+func entryAt(action, id string, seconds int64, values map[string]interface{}) *timedEntry {
+	return &timedEntry{rawEntry{action, "testing", "user", id, values}, time.Unix(seconds, 0)}
+}
+
+func TestCoalescer(t *testing.T) {
+	tests := []struct {
+		entries []*timedEntry
+		action  string
+		doc     map[string]interface{}
+	}{
+		{
+			[]*timedEntry{
+				entryAt("update", "1", 1, map[string]interface{}{"a": 1, "b": 1}),
+				entryAt("update", "1", 2, map[string]interface{}{"b": 2, "c": nil}),
+			},
+			"update", map[string]interface{}{"a": 1, "b": 2, "c": nil},
+		},
+		{
+			[]*timedEntry{
+				entryAt("index", "1", 1, map[string]interface{}{"a": 1, "b": 1}),
+				entryAt("update", "1", 2, map[string]interface{}{"b": 2}),
+				entryAt("update", "1", 3, map[string]interface{}{"c": 3}),
+			},
+			"index", map[string]interface{}{"a": 1, "b": 2, "c": 3},
+		},
+		{
+			[]*timedEntry{
+				entryAt("index", "1", 1, map[string]interface{}{"a": 1}),
+				entryAt("update", "1", 2, map[string]interface{}{"b": 2}),
+				entryAt("delete", "1", 3, nil),
+			},
+			"delete", nil,
+		},
+		{
+			[]*timedEntry{
+				entryAt("delete", "1", 1, nil),
+				entryAt("update", "1", 2, map[string]interface{}{"b": 2}),
+			},
+			"index", map[string]interface{}{"b": 2},
+		},
+		{
+			[]*timedEntry{
+				entryAt("update", "1", 1, map[string]interface{}{"a": 1}),
+				entryAt("index", "1", 2, map[string]interface{}{"b": 2}),
+			},
+			"index", map[string]interface{}{"b": 2},
+		},
+	}
+
+	for n, test := range tests {
+		c := NewCoalescer()
+		for _, entry := range test.entries {
+			if err := c.Add(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		drained := c.Drain()
+		if len(drained) != 1 {
+			t.Fatal(n, "expected one transaction, got", len(drained))
+		}
+		if a, _ := drained[0].Action(); a != test.action {
+			t.Error(n, "expected action", test.action, "got", a)
+		}
+		if d, _ := drained[0].Document(); !reflect.DeepEqual(d, test.doc) {
+			t.Errorf("%d: expected %v got %v", n, test.doc, d)
+		}
+		last := test.entries[len(test.entries)-1]
+		if ts := drained[0].Time(); !ts.Equal(last.ts) {
+			t.Error(n, "expected the last timestamp to be kept, got", ts)
+		}
+		if c.Len() != 0 {
+			t.Error(n, "expected coalescer to be empty after drain")
+		}
+	}
+}
+
+func TestCoalescerOrder(t *testing.T) {
+	c := NewCoalescer()
+	for _, id := range []string{"1", "2", "1", "3", "2"} {
+		c.Add(entryAt("update", id, 1, map[string]interface{}{"a": id}))
+	}
+	var ids []string
+	for _, tr := range c.Drain() {
+		id, _ := tr.Id()
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+		t.Error("Expected documents in the order first seen, got", ids)
+	}
+}
+
+type versionedTransaction struct {
+	*timedEntry
+	version int64
+}
+
+func (v versionedTransaction) Version() (int64, error) {
+	return v.version, nil
+}
+
+func TestCoalescerOverlap(t *testing.T) {
+	c := NewCoalescer()
+	c.Add(entryAt("update", "1", 1, map[string]interface{}{"profile": map[string]interface{}{"city": "a"}}))
+	c.Add(entryAt("update", "1", 2, map[string]interface{}{"profile.city": "b"}))
+	c.Add(entryAt("update", "1", 3, map[string]interface{}{"profile.city": "c", "age": 3}))
+	c.Add(entryAt("update", "2", 4, map[string]interface{}{"profile.city": "d", "profile.zip": 1}))
+	drained := c.Drain()
+	valid := []map[string]interface{}{
+		{"profile": map[string]interface{}{"city": "a"}},
+		{"profile.city": "c", "age": 3},
+		{"profile.city": "d", "profile.zip": 1},
+	}
+	if len(drained) != len(valid) {
+		t.Fatal("Expected overlapping updates to be kept apart, got", len(drained))
+	}
+	for n, tr := range drained {
+		if d, _ := tr.Document(); !reflect.DeepEqual(d, valid[n]) {
+			t.Errorf("%d: expected %v got %v", n, valid[n], d)
+		}
+	}
+}
+
+func TestCoalescerVersion(t *testing.T) {
+	c := NewCoalescer()
+	c.Add(entryAt("index", "1", 1, map[string]interface{}{"a": 1}))
+	c.Add(versionedTransaction{entryAt("index", "2", 1, map[string]interface{}{"a": 2}), 7})
+	bulk := NewBulkBody(MB)
+	bulk.Options = BulkOptions{Version: Version{Major: 8}, ExternalVersion: true}
+	for _, tr := range c.Drain() {
+		if err := bulk.Add(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(bulk.String(), "\n")
+	if valid := `{"index":{"_index":"testing","_id":"1"}}`; lines[0] != valid {
+		t.Errorf("\n'%s'\nNot equal to:\n'%s'", lines[0], valid)
+	}
+	if valid := `{"index":{"_index":"testing","_id":"2","version":7,"version_type":"external"}}`; lines[2] != valid {
+		t.Errorf("\n'%s'\nNot equal to:\n'%s'", lines[2], valid)
+	}
+}
+
+// ackedTransaction counts how many times it was acknowledged.
+type ackedTransaction struct {
+	*timedEntry
+	acked *int
+}
+
+func (a ackedTransaction) Acknowledge(err error) {
+	*a.acked++
+}
+
+func TestCoalescerAcknowledge(t *testing.T) {
+	var acked int
+	c := NewCoalescer()
+	c.Add(ackedTransaction{entryAt("update", "1", 1, map[string]interface{}{"a": 1}), &acked})
+	c.Add(entryAt("update", "1", 2, map[string]interface{}{"b": 2}))
+	c.Add(ackedTransaction{entryAt("update", "1", 3, map[string]interface{}{"c": 3}), &acked})
+	drained := c.Drain()
+	if len(drained) != 1 {
+		t.Fatal("Expected one transaction, got", len(drained))
+	}
+	drained[0].(Acknowledger).Acknowledge(nil)
+	if acked != 2 {
+		t.Error("Expected every merged transaction to be acknowledged, got", acked)
+	}
+}
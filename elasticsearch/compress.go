@@ -0,0 +1,70 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+)
+
+// compressor gzips request bodies, reusing writers and buffers between requests.
+type compressor struct {
+	level   int
+	writers sync.Pool
+	buffers sync.Pool
+}
+
+func newCompressor(level int) (*compressor, error) {
+	// Let gzip validate the level up front rather than on the first request.
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	return &compressor{level: level}, nil
+}
+
+// compress returns a buffer with the gzipped body, it should be handed back with release when the
+// request is done.
+func (c *compressor) compress(body []byte) (*bytes.Buffer, error) {
+	buf, _ := c.buffers.Get().(*bytes.Buffer)
+	if buf == nil {
+		buf = new(bytes.Buffer)
+	}
+	buf.Reset()
+
+	w, _ := c.writers.Get().(*gzip.Writer)
+	if w == nil {
+		w, _ = gzip.NewWriterLevel(buf, c.level)
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(body); err != nil {
+		c.release(buf)
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		c.release(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *compressor) release(buf *bytes.Buffer) {
+	c.buffers.Put(buf)
+}
+
+// SetGzip turns on gzip compression of request bodies using the level as defined by compress/gzip,
+// 0 turns compression off. It should be called before sending requests.
+func (c *Client) SetGzip(level int) error {
+	if level == gzip.NoCompression {
+		c.gzip = nil
+		return nil
+	}
+	gz, err := newCompressor(level)
+	if err != nil {
+		return err
+	}
+	c.gzip = gz
+	return nil
+}
@@ -0,0 +1,34 @@
+package elasticsearch
+
+import (
+	"sync"
+)
+
+// Flusher makes all slurpers sharing it send what they have collected right away, without waiting
+// for any of the FlushLimits. A nil Flusher never flushes.
+type Flusher struct {
+	mu sync.Mutex
+	c  chan bool
+}
+
+func NewFlusher() *Flusher {
+	return &Flusher{c: make(chan bool)}
+}
+
+// Flush signals the slurpers to send their bulk requests, it doesn't wait for them to be sent.
+func (f *Flusher) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.c)
+	f.c = make(chan bool)
+}
+
+// wait returns a channel that is closed by the next Flush.
+func (f *Flusher) wait() <-chan bool {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.c
+}
@@ -0,0 +1,17 @@
+package elasticsearch
+
+import (
+	"hash/fnv"
+)
+
+// Partition returns which of n partitions the transaction belongs to. It's decided by the id only, so
+// that all operations on one document end up in the same partition whatever index they are sent to.
+func Partition(t Identifier, n int) (int, error) {
+	id, err := t.Id()
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n)), nil
+}
@@ -0,0 +1,26 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPartition(t *testing.T) {
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		entry := &rawEntry{id: fmt.Sprintf("%024x", i)}
+		p, err := Partition(entry, len(counts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := Partition(&rawEntry{index: "other", id: entry.id}, len(counts)); again != p {
+			t.Fatal("Expected the same id to always get the same partition")
+		}
+		counts[p]++
+	}
+	for p, count := range counts {
+		if count < 150 {
+			t.Error("Expected ids to be spread over partitions, partition", p, "got", count)
+		}
+	}
+}
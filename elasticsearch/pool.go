@@ -0,0 +1,183 @@
+package elasticsearch
+
+import (
+	"context"
+	"github.com/duego/cryriver/stats"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Pool runs a varying number of slurpers sharing one channel, between a min and a max. Adjust grows
+// the pool while transactions queue up in the channel and shrinks it when the queue is empty or when
+// bulk requests are getting slower, which tells that elasticsearch isn't keeping up.
+type Pool struct {
+	ctx      context.Context
+	client   BulkSender
+	esc      chan Transaction
+	options  BulkOptions
+	limits   FlushLimits
+	throttle *Throttle
+	flusher  *Flusher
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	min, max int
+	closed   bool
+	stops    []chan bool
+	slurpers sync.WaitGroup
+	latency  time.Duration // Moving average of bulk requests
+	previous time.Duration // Latency at the previous adjustment
+}
+
+// NewPool returns a Pool of slurpers reading from esc, see Slurp. No slurpers are started until
+// Resize is called, they are all cancelled when ctx is done.
+func NewPool(ctx context.Context, client BulkSender, esc chan Transaction, options BulkOptions, limits FlushLimits, throttle *Throttle, flusher *Flusher, logger *slog.Logger, min, max int) *Pool {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	p := &Pool{
+		ctx:      ctx,
+		esc:      esc,
+		options:  options,
+		limits:   limits,
+		throttle: throttle,
+		flusher:  flusher,
+		logger:   logger,
+		min:      min,
+		max:      max,
+	}
+	p.client = timedSender{client, p}
+	return p
+}
+
+// Size returns the number of running slurpers.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
+
+// Bounds returns the least and the most slurpers the pool may run.
+func (p *Pool) Bounds() (min, max int) {
+	return p.min, p.max
+}
+
+// Latency returns the moving average of how long bulk requests take.
+func (p *Pool) Latency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latency
+}
+
+// Resize starts or stops slurpers until there are n of them, within the bounds of the pool. Stopped
+// slurpers send what they have collected before returning. Returns the new size.
+func (p *Pool) Resize(n int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return len(p.stops)
+	}
+	if n < p.min {
+		n = p.min
+	}
+	if n > p.max {
+		n = p.max
+	}
+	for len(p.stops) < n {
+		stop := make(chan bool)
+		p.stops = append(p.stops, stop)
+		p.slurpers.Add(1)
+		go func() {
+			slurp(p.ctx, p.client, p.esc, p.options, p.limits, p.throttle, p.flusher, p.logger, stop)
+			p.slurpers.Done()
+		}()
+	}
+	for len(p.stops) > n {
+		last := len(p.stops) - 1
+		close(p.stops[last])
+		p.stops = p.stops[:last]
+	}
+	stats.Slurpers.Set(int64(n))
+	stats.SlurperCount.Set(float64(n))
+	return n
+}
+
+// Adjust resizes the pool every interval until ctx is done. The channel must be buffered for the pool
+// to tell how many transactions are queued.
+func (p *Pool) Adjust(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Resize(p.next())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// next decides the size of the pool from how full the channel is and how bulk latency changed since
+// the last adjustment. More slurpers are only added while they don't make requests much slower.
+func (p *Pool) next() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := len(p.stops)
+	if cap(p.esc) == 0 {
+		return size
+	}
+	queued := float64(len(p.esc)) / float64(cap(p.esc))
+	slower := p.previous > 0 && p.latency > p.previous*3/2
+	switch {
+	case queued >= 0.5 && !slower:
+		size++
+	case queued == 0 || p.previous > 0 && p.latency > p.previous*2:
+		size--
+	}
+	p.previous = p.latency
+	return size
+}
+
+// Close closes the channel so that the slurpers send what they have collected and return, the pool
+// can't be resized afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.esc)
+	}
+}
+
+// Wait blocks until all slurpers have returned.
+func (p *Pool) Wait() {
+	p.slurpers.Wait()
+}
+
+func (p *Pool) observe(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency == 0 {
+		p.latency = d
+	} else {
+		p.latency = (p.latency*4 + d) / 5
+	}
+	stats.BulkLatency.Set(int64(p.latency / time.Millisecond))
+}
+
+// timedSender measures the latency of bulk requests for the pool.
+type timedSender struct {
+	BulkSender
+	pool *Pool
+}
+
+func (t timedSender) BulkSend(ctx context.Context, b *BulkBody) error {
+	start := time.Now()
+	err := t.BulkSender.BulkSend(ctx, b)
+	t.pool.observe(time.Since(start))
+	return err
+}
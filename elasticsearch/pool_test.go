@@ -0,0 +1,65 @@
+package elasticsearch
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPoolResize(t *testing.T) {
+	sender := &recordingSender{make(chan int, 10)}
+	esc := make(chan Transaction)
+	pool := NewPool(context.Background(), sender, esc, BulkOptions{}, FlushLimits{MaxAge: time.Hour}, nil, nil, nil, 1, 3)
+
+	if n := pool.Resize(5); n != 3 || pool.Size() != 3 {
+		t.Error("Expected the pool to be limited to 3 slurpers, got", n)
+	}
+	for i := 0; i < 3; i++ {
+		esc <- entryAt("index", strconv.Itoa(i), 1, map[string]interface{}{"a": i})
+	}
+
+	// Stopped slurpers send what they have before returning.
+	if n := pool.Resize(0); n != 1 || pool.Size() != 1 {
+		t.Error("Expected the pool to keep 1 slurper, got", n)
+	}
+	pool.Close()
+	pool.Wait()
+	close(sender.sent)
+	var sent int
+	for n := range sender.sent {
+		sent += n
+	}
+	if sent != 3 {
+		t.Error("Expected all 3 operations to be sent, got", sent)
+	}
+	if pool.Resize(2) != 1 {
+		t.Error("Expected a closed pool to not be resized")
+	}
+}
+
+func TestPoolNext(t *testing.T) {
+	esc := make(chan Transaction, 4)
+	pool := NewPool(context.Background(), &recordingSender{make(chan int, 10)}, esc, BulkOptions{}, FlushLimits{}, nil, nil, nil, 1, 4)
+	pool.stops = make([]chan bool, 2)
+
+	if n := pool.next(); n != 1 {
+		t.Error("Expected an empty queue to shrink the pool, got", n)
+	}
+
+	esc <- entryAt("index", "1", 1, nil)
+	esc <- entryAt("index", "2", 1, nil)
+	pool.latency = 100 * time.Millisecond
+	if n := pool.next(); n != 3 {
+		t.Error("Expected a queue half full to grow the pool, got", n)
+	}
+
+	pool.latency = 160 * time.Millisecond
+	if n := pool.next(); n != 2 {
+		t.Error("Expected slower requests to keep the pool, got", n)
+	}
+	pool.latency = 400 * time.Millisecond
+	if n := pool.next(); n != 1 {
+		t.Error("Expected much slower requests to shrink the pool, got", n)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
 )
 
 type ByteSize int64
@@ -26,110 +29,353 @@ type BulkEntry interface {
 // BulkBodyFull will be returned when the configured max ByteSize has been reached
 var BulkBodyFull = errors.New("No more operations can be added")
 
+// DefaultMaxContentLength is the default http.max_content_length of elasticsearch.
+const DefaultMaxContentLength = 100 * MB
+
+// EntryTooLarge is returned when adding an operation that is larger than the cluster accepts in one
+// request.
+type EntryTooLarge struct {
+	Index string
+	Id    string
+	Size  ByteSize
+}
+
+func (e EntryTooLarge) Error() string {
+	return fmt.Sprintf("Operation on %s/%s is %d bytes, larger than the max content length", e.Index, e.Id, e.Size)
+}
+
+// BulkOptions decides how entries are written to a BulkBody.
+type BulkOptions struct {
+	// Version of the cluster, which decides what metadata is written for each entry.
+	Version Version
+
+	// Pipeline is the ingest pipeline to run indexed documents through.
+	Pipeline string
+
+	// RequireAlias makes indexing fail unless the index is an alias, needs elasticsearch 7.10 or
+	// OpenSearch.
+	RequireAlias bool
+
+	// RetryOnConflict is how many times updates are retried on version conflicts.
+	RetryOnConflict int
+
+	// ExternalVersion sends the version of entries implementing Versioner, so that ES rejects writes
+	// older than what it already has. Version conflicts are then treated as success. Only index and
+	// delete can be versioned, ES doesn't support external versions for partial updates.
+	ExternalVersion bool
+
+	// MaxContentLength is the http.max_content_length of the cluster, operations larger than this
+	// are rejected with EntryTooLarge. Defaults to DefaultMaxContentLength.
+	MaxContentLength ByteSize
+
+	// Coalesce merges operations on the same document that are waiting to be sent, see Coalescer.
+	Coalesce bool
+}
+
+// Versioner can be implemented by a BulkEntry to provide an external version, which must grow with
+// every change of the document.
+type Versioner interface {
+	Version() (int64, error)
+}
+
+// Router can be implemented by a BulkEntry to select which shard it should be routed to.
+type Router interface {
+	Routing() (string, error)
+}
+
+// Acknowledger can be implemented by a BulkEntry to be told once elasticsearch has answered for it,
+// with nil if it was written or why it wasn't. Entries with nothing to send are acknowledged when
+// added. Entries that are never sent, such as when sending is cancelled, are never acknowledged.
+type Acknowledger interface {
+	Acknowledge(err error)
+}
+
 // BulkBody creates valid bulk data to be used by ES _bulk requests.
 // http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/docs-bulk.html
 type BulkBody struct {
 	*bytes.Buffer
-	max  ByteSize
-	done bool
+	Options BulkOptions
+	max     ByteSize
+	done    bool
+	offsets []int          // Where each entry starts in the buffer
+	links   []trace.Link   // The span of each entry, see Contexter
+	acks    []Acknowledger // Nil for entries that aren't Acknowledgers
+
+	// Entries are encoded straight into the buffer, reusing the headers between entries.
+	encoder  *json.Encoder
+	legacy   indexHeader
+	typeless typelessHeader
+	version  int64
 }
 
-// indexHeader is the first part of a bulk request, the second part is the values
+// indexHeader is the first part of a bulk request for clusters using mapping types, the second part
+// is the values
 type indexHeader struct {
-	Name string `json:"_index"`
-	Type string `json:"_type"`
-	Id   string `json:"_id"`
+	Name            string `json:"_index"`
+	Type            string `json:"_type"`
+	Id              string `json:"_id"`
+	Routing         string `json:"_routing,omitempty"`
+	Pipeline        string `json:"pipeline,omitempty"`
+	RetryOnConflict int    `json:"_retry_on_conflict,omitempty"`
+	Version         *int64 `json:"_version,omitempty"`
+	VersionType     string `json:"_version_type,omitempty"`
+}
+
+// typelessHeader is the header used by elasticsearch 7 and later, and OpenSearch.
+type typelessHeader struct {
+	Name            string `json:"_index"`
+	Id              string `json:"_id"`
+	Routing         string `json:"routing,omitempty"`
+	Pipeline        string `json:"pipeline,omitempty"`
+	RequireAlias    bool   `json:"require_alias,omitempty"`
+	RetryOnConflict int    `json:"retry_on_conflict,omitempty"`
+	Version         *int64 `json:"version,omitempty"`
+	VersionType     string `json:"version_type,omitempty"`
+}
+
+// updateBody wraps the document of updates.
+type updateBody struct {
+	Doc         map[string]interface{} `json:"doc"`
+	DocAsUpsert bool                   `json:"doc_as_upsert"`
+}
+
+// Buffers of released bodies, they grow as needed and are kept for the next body.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
 // NewBulkBody will return a new BulkBody configured to return an error upon adding more bytes than
-// max.
+// max. The buffer is taken from a pool, call Release when done with the body to return it.
 func NewBulkBody(max ByteSize) *BulkBody {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
 	return &BulkBody{
-		Buffer: bytes.NewBuffer(make([]byte, 0, max)),
-		max:    max,
+		Buffer:  buf,
+		max:     max,
+		encoder: json.NewEncoder(buf),
 	}
 }
 
-// Add will write one new bulk operation to the buffer. Returns BulkBodyFull when maxed out.
-// If BulkBodyFull has been returned, the buffer should be sent and Reset() until more operations
-// can be added.
+// Release returns the buffer to the pool, the BulkBody can't be used afterwards.
+func (bulk *BulkBody) Release() {
+	if bulk.Buffer != nil {
+		bufferPool.Put(bulk.Buffer)
+		bulk.Buffer, bulk.encoder = nil, nil
+	}
+}
+
+// Add will write one new bulk operation to the buffer. Returns BulkBodyFull without writing anything
+// if the operation would make the buffer grow past its max size, the buffer should then be sent and
+// Reset() before adding the operation again. An operation larger than max is still added to an empty
+// buffer so that it is sent on its own, unless it exceeds MaxContentLength.
 func (bulk *BulkBody) Add(v BulkEntry) error {
 	// Clear done bool on resets
-	if bulk.Len() == 0 && bulk.done {
+	if bulk.Len() == 0 {
 		bulk.done = false
+		bulk.offsets = bulk.offsets[:0]
+		bulk.links = bulk.links[:0]
+		bulk.acks = bulk.acks[:0]
 	}
 	// Don't allow more additions if we are full
 	if bulk.done {
 		return BulkBodyFull
 	}
-	if ByteSize(bulk.Len()) >= bulk.max {
-		bulk.Done()
-		return BulkBodyFull
-	}
 
-	// First part is a header identifying what to do
-	header := indexHeader{}
-	if i, err := v.Index(); err != nil {
+	mark := bulk.Len()
+	written, err := bulk.encode(v)
+	if err != nil || !written {
+		bulk.Truncate(mark)
+		if a, ok := v.(Acknowledger); ok && err == nil {
+			a.Acknowledge(nil)
+		}
 		return err
-	} else {
-		header.Name = i
 	}
-	if t, err := v.Type(); err != nil {
-		return err
-	} else {
-		header.Type = t
+
+	// Room is left for the final newline written by Done.
+	size := ByteSize(bulk.Len() - mark + 1)
+	limit := bulk.Options.MaxContentLength
+	if limit <= 0 {
+		limit = DefaultMaxContentLength
 	}
-	if id, err := v.Id(); err != nil {
-		return err
-	} else {
-		header.Id = id
+	if size > limit {
+		bulk.Truncate(mark)
+		index, _ := v.Index()
+		id, _ := v.Id()
+		return EntryTooLarge{index, id, size}
 	}
+	if mark > 0 && ByteSize(mark)+size > bulk.max {
+		bulk.Truncate(mark)
+		bulk.Done()
+		return BulkBodyFull
+	}
+	bulk.offsets = append(bulk.offsets, mark)
+	var link trace.Link
+	if c, ok := v.(Contexter); ok {
+		link = trace.LinkFromContext(c.Context())
+	}
+	bulk.links = append(bulk.links, link)
+	a, _ := v.(Acknowledger)
+	bulk.acks = append(bulk.acks, a)
+	return nil
+}
+
+// encode writes the bulk lines for one operation at the end of the buffer. Returns false if there
+// was nothing to send, the caller is responsible for truncating what was written in that case or on
+// errors.
+func (bulk *BulkBody) encode(v BulkEntry) (bool, error) {
+	// First part is a header identifying what to do
 	action, err := v.Action()
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	parts := make([][]byte, 0, 3)
-	if headerJson, err := json.Marshal(map[string]interface{}{action: header}); err != nil {
-		return err
-	} else {
-		parts = append(parts, headerJson)
+	header, err := bulk.header(v, action)
+	if err != nil {
+		return false, err
 	}
 
 	// Then is the values that should be applied
 	doc, err := v.Document()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// No need to send operations that wouldn't change anything
 	if action != "delete" && len(doc) == 0 {
-		return nil
+		return false, nil
 	}
 
+	// The encoder ends every value with a newline, which is also the bulk delimiter. The header is
+	// wrapped in the action, so its newline is replaced with the closing brace.
+	bulk.WriteString(`{"`)
+	bulk.WriteString(action)
+	bulk.WriteString(`":`)
+	if err := bulk.encoder.Encode(header); err != nil {
+		return false, err
+	}
+	bulk.Truncate(bulk.Len() - 1)
+	bulk.WriteString("}\n")
+
+	switch action {
+	// Deletes doesn't need to provide values
+	case "delete":
+		return true, nil
 	// Updates needs to be wrapped with additional options
-	if action == "update" {
-		doc = map[string]interface{}{
-			"doc":           doc,
-			"doc_as_upsert": true,
+	case "update":
+		return true, bulk.encoder.Encode(updateBody{doc, true})
+	default:
+		return true, bulk.encoder.Encode(doc)
+	}
+}
+
+// Entries returns the number of operations added since the buffer was last reset.
+func (bulk *BulkBody) Entries() int {
+	if bulk.Len() == 0 {
+		return 0
+	}
+	return len(bulk.offsets)
+}
+
+// Links returns links to the spans of the entries in the buffer, for entries implementing Contexter.
+func (bulk *BulkBody) Links() []trace.Link {
+	var links []trace.Link
+	for _, link := range bulk.links[:bulk.Entries()] {
+		if link.SpanContext.IsValid() {
+			links = append(links, link)
 		}
 	}
+	return links
+}
 
-	// Deletes doesn't need to provide values
-	if action != "delete" {
-		valuesJson, err := json.Marshal(doc)
-		if err != nil {
-			return err
+// acknowledge tells the entry at position n, if it is an Acknowledger, that elasticsearch answered
+// for it with err.
+func (bulk *BulkBody) acknowledge(n int, err error) {
+	if n < bulk.Entries() && bulk.acks[n] != nil {
+		bulk.acks[n].Acknowledge(err)
+	}
+}
+
+// SetMax changes the size the buffer may grow to, it applies to entries added from now on.
+func (bulk *BulkBody) SetMax(max ByteSize) {
+	bulk.max = max
+}
+
+// Retain keeps only the entries at the given positions, in ascending order, so that they can be sent
+// again.
+func (bulk *BulkBody) Retain(positions []int) {
+	end := bulk.Len()
+	if bulk.done {
+		end--
+	}
+	b := bulk.Bytes()
+	var w int
+	// Offsets are rewritten in place, never ahead of the ones still to be read.
+	offsets, links, acks := bulk.offsets[:0], bulk.links[:0], bulk.acks[:0]
+	for _, p := range positions {
+		if p < 0 || p >= len(bulk.offsets) {
+			continue
+		}
+		links = append(links, bulk.links[p])
+		acks = append(acks, bulk.acks[p])
+		start, stop := bulk.offsets[p], end
+		if p+1 < len(bulk.offsets) {
+			stop = bulk.offsets[p+1]
+		}
+		// Entries only move towards the start, so the ones still to be copied are never overwritten.
+		copy(b[w:], b[start:stop])
+		offsets = append(offsets, w)
+		w += stop - start
+	}
+	bulk.offsets, bulk.links, bulk.acks = offsets, links, acks
+	bulk.done = false
+	bulk.Truncate(w)
+}
+
+// header returns the metadata for the entry in the format of the configured version.
+func (bulk *BulkBody) header(v BulkEntry, action string) (interface{}, error) {
+	index, err := v.Index()
+	if err != nil {
+		return nil, err
+	}
+	id, err := v.Id()
+	if err != nil {
+		return nil, err
+	}
+	var routing string
+	if r, ok := v.(Router); ok {
+		if routing, err = r.Routing(); err != nil {
+			return nil, err
 		}
-		parts = append(parts, valuesJson)
+	}
+	var pipeline string
+	if action == "index" {
+		pipeline = bulk.Options.Pipeline
+	}
+	var retries int
+	if action == "update" {
+		retries = bulk.Options.RetryOnConflict
 	}
 
-	// Header, values (in case they exist) and final delimeter is separated by newlines
-	parts = append(parts, nil)
-	entry := bytes.Join(parts, []byte{newline})
-	_, err = (*bulk).Write(entry)
+	var version *int64
+	var versionType string
+	if versioner, ok := v.(Versioner); ok && bulk.Options.ExternalVersion && action != "update" {
+		if bulk.version, err = versioner.Version(); err != nil {
+			return nil, err
+		}
+		version, versionType = &bulk.version, "external"
+	}
 
-	return err
+	// The headers are kept in the body to not allocate new ones for every entry.
+	if bulk.Options.Version.legacy() {
+		t, err := v.Type()
+		if err != nil {
+			return nil, err
+		}
+		bulk.legacy = indexHeader{index, t, id, routing, pipeline, retries, version, versionType}
+		return &bulk.legacy, nil
+	}
+	requireAlias := bulk.Options.RequireAlias && action != "delete" && bulk.Options.Version.requireAlias()
+	bulk.typeless = typelessHeader{index, id, routing, pipeline, requireAlias, retries, version, versionType}
+	return &bulk.typeless, nil
 }
 
 // Done will append the final byte to mark the end of a bulk body. Should be called after all
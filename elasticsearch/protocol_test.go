@@ -2,7 +2,9 @@ package elasticsearch
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -138,3 +140,237 @@ func TestBulkDone(t *testing.T) {
 		t.Fatal("Expected done flag to be reset on new addition")
 	}
 }
+
+type routedEntry struct {
+	rawEntry
+	routing string
+}
+
+func (r *routedEntry) Routing() (string, error) {
+	return r.routing, nil
+}
+
+func TestBulkBodyVersions(t *testing.T) {
+	tests := []struct {
+		options BulkOptions
+		entry   BulkEntry
+		valid   string
+	}{
+		{
+			BulkOptions{Version: Version{Major: 8}},
+			&rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}},
+			`{"index":{"_index":"testing","_id":"123"}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 2, OpenSearch: true}, Pipeline: "users", RequireAlias: true},
+			&routedEntry{rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}, "42"},
+			`{"index":{"_index":"testing","_id":"123","routing":"42","pipeline":"users","require_alias":true}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 7, Minor: 9}, Pipeline: "users", RequireAlias: true, RetryOnConflict: 3},
+			&rawEntry{"update", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}},
+			`{"update":{"_index":"testing","_id":"123","retry_on_conflict":3}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 1, Minor: 7}, RetryOnConflict: 3},
+			&routedEntry{rawEntry{"update", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}, "42"},
+			`{"update":{"_index":"testing","_type":"user","_id":"123","_routing":"42","_retry_on_conflict":3}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 8}, RequireAlias: true, RetryOnConflict: 3},
+			&rawEntry{"delete", "testing", "user", "123", nil},
+			`{"delete":{"_index":"testing","_id":"123"}}`,
+		},
+	}
+	for _, test := range tests {
+		bulk := NewBulkBody(MB)
+		bulk.Options = test.options
+		if err := bulk.Add(test.entry); err != nil {
+			t.Fatal(err)
+		}
+		if header := strings.SplitN(bulk.String(), "\n", 2)[0]; header != test.valid {
+			t.Errorf("\n'%s'\nNot equal to:\n'%s'", header, test.valid)
+		}
+	}
+}
+
+type versionedEntry struct {
+	rawEntry
+	version int64
+}
+
+func (v *versionedEntry) Version() (int64, error) {
+	return v.version, nil
+}
+
+func TestBulkBodyExternalVersion(t *testing.T) {
+	tests := []struct {
+		options BulkOptions
+		entry   BulkEntry
+		valid   string
+	}{
+		{
+			BulkOptions{Version: Version{Major: 8}, ExternalVersion: true},
+			&versionedEntry{rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}, 5984286097973182465},
+			`{"index":{"_index":"testing","_id":"123","version":5984286097973182465,"version_type":"external"}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 1}, ExternalVersion: true},
+			&versionedEntry{rawEntry{"delete", "testing", "user", "123", nil}, 1},
+			`{"delete":{"_index":"testing","_type":"user","_id":"123","_version":1,"_version_type":"external"}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 8}, ExternalVersion: true},
+			&versionedEntry{rawEntry{"update", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}, 1},
+			`{"update":{"_index":"testing","_id":"123"}}`,
+		},
+		{
+			BulkOptions{Version: Version{Major: 8}},
+			&versionedEntry{rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}, 1},
+			`{"index":{"_index":"testing","_id":"123"}}`,
+		},
+	}
+	for _, test := range tests {
+		bulk := NewBulkBody(MB)
+		bulk.Options = test.options
+		if err := bulk.Add(test.entry); err != nil {
+			t.Fatal(err)
+		}
+		if header := strings.SplitN(bulk.String(), "\n", 2)[0]; header != test.valid {
+			t.Errorf("\n'%s'\nNot equal to:\n'%s'", header, test.valid)
+		}
+	}
+}
+
+func TestBulkBodyNeverExceedsMax(t *testing.T) {
+	bulk := NewBulkBody(200)
+	entry := &rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}
+	var added int
+	for {
+		err := bulk.Add(entry)
+		if err == BulkBodyFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		added++
+	}
+	if added == 0 {
+		t.Fatal("Expected some entries to fit")
+	}
+	if bulk.Entries() != added {
+		t.Error("Expected", added, "entries, got", bulk.Entries())
+	}
+	if bulk.Len() > 200 {
+		t.Error("Expected bulk body to stay within 200 bytes, got", bulk.Len())
+	}
+}
+
+func TestBulkBodyOversized(t *testing.T) {
+	bulk := NewBulkBody(10)
+	bulk.Options.MaxContentLength = 100
+	entry := &rawEntry{"index", "testing", "user", "123", map[string]interface{}{"alias": "Johnny"}}
+	if err := bulk.Add(entry); err != nil {
+		t.Fatal("Expected an oversized entry to be added to an empty body, got", err)
+	}
+	if err := bulk.Add(entry); err != BulkBodyFull {
+		t.Fatal("Expected nothing to be added after an oversized entry, got", err)
+	}
+
+	bulk.Reset()
+	entry.values["alias"] = strings.Repeat("Johnny", 20)
+	err := bulk.Add(entry)
+	if tooLarge, ok := err.(EntryTooLarge); !ok || tooLarge.Id != "123" {
+		t.Fatal("Expected EntryTooLarge, got", err)
+	}
+	if bulk.Len() != 0 {
+		t.Error("Expected nothing to be written, got", bulk.Len(), "bytes")
+	}
+}
+
+func benchmarkEntries() []*rawEntry {
+	doc := map[string]interface{}{
+		"alias":    "Johnny",
+		"age":      32,
+		"verified": true,
+		"location": map[string]interface{}{"city": "Stockholm", "lat": 59.33, "lon": 18.07},
+		"tags":     []interface{}{"music", "travel", "food"},
+	}
+	return []*rawEntry{
+		{"index", "testing", "user", "123", doc},
+		{"update", "testing", "user", "124", doc},
+		{"delete", "testing", "user", "125", nil},
+	}
+}
+
+func BenchmarkBulkBodyAdd(b *testing.B) {
+	entries := benchmarkEntries()
+	bulk := NewBulkBody(MB)
+	defer bulk.Release()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bulk.Add(entries[i%len(entries)]); err == BulkBodyFull {
+			bulk.Reset()
+		} else if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// marshalEntry encodes an entry the way BulkBody did before writing straight to its buffer, kept
+// to compare against.
+func marshalEntry(v *rawEntry) ([]byte, error) {
+	header, err := json.Marshal(map[string]interface{}{v.action: indexHeader{Name: v.index, Type: v._type, Id: v.id}})
+	if err != nil {
+		return nil, err
+	}
+	parts := [][]byte{header}
+	doc := v.values
+	if v.action == "update" {
+		doc = map[string]interface{}{"doc": doc, "doc_as_upsert": true}
+	}
+	if v.action != "delete" {
+		values, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, values)
+	}
+	return bytes.Join(append(parts, nil), []byte{newline}), nil
+}
+
+func BenchmarkBulkBodyMarshal(b *testing.B) {
+	entries := benchmarkEntries()
+	buf := bytes.NewBuffer(make([]byte, 0, MB))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry, err := marshalEntry(entries[i%len(entries)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if ByteSize(buf.Len()+len(entry)) > MB {
+			buf.Reset()
+		}
+		buf.Write(entry)
+	}
+}
+
+func TestBulkBodyMatchesMarshal(t *testing.T) {
+	for _, entry := range benchmarkEntries() {
+		bulk := NewBulkBody(MB)
+		if err := bulk.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+		expected, err := marshalEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bulk.Bytes(), expected) {
+			t.Errorf("\n'%s'\nNot equal to:\n'%s'", bulk.Bytes(), expected)
+		}
+		bulk.Release()
+	}
+}
@@ -0,0 +1,168 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BulkResponse is the reply to a bulk request.
+type BulkResponse struct {
+	Took   int                    `json:"took"`
+	Errors bool                   `json:"errors"`
+	Items  []map[string]*BulkItem `json:"items"`
+}
+
+// BulkItem is the result of one entry in a bulk request.
+type BulkItem struct {
+	Index  string         `json:"_index"`
+	Type   string         `json:"_type"`
+	Id     string         `json:"_id"`
+	Status int            `json:"status"`
+	Error  *BulkItemError `json:"error"`
+}
+
+// BulkItemError describes why an entry failed. Elasticsearch 1.x reports errors as a string such as
+// "MapperParsingException[failed to parse]", later versions as an object with type and reason.
+type BulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (e *BulkItemError) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		e.Type = strings.SplitN(s, "[", 2)[0]
+		e.Reason = s
+		return nil
+	}
+	// Alias to not recurse into this method
+	type itemError BulkItemError
+	return json.Unmarshal(b, (*itemError)(e))
+}
+
+func (e *BulkItemError) Error() string {
+	return e.Type + ": " + e.Reason
+}
+
+// Rejected reports whether elasticsearch was too busy to handle the item, in which case it can be
+// sent again later.
+func (item *BulkItem) Rejected() bool {
+	if item.Status == http.StatusTooManyRequests {
+		return true
+	}
+	// Elasticsearch 1.x reports the exception in its Java form.
+	return item.Error != nil &&
+		(item.Error.Type == "es_rejected_execution_exception" || item.Error.Type == "EsRejectedExecutionException")
+}
+
+// Rejected returns the positions of the items that were rejected, in the order they were sent.
+func (r *BulkResponse) Rejected() []int {
+	if !r.Errors {
+		return nil
+	}
+	var rejected []int
+	for n, item := range r.Items {
+		for _, result := range item {
+			if result.Rejected() {
+				rejected = append(rejected, n)
+			}
+		}
+	}
+	return rejected
+}
+
+// Failed returns the items that did not succeed, except for rejected ones. Version conflicts of
+// index and delete items can be ignored when using external versions, as they only mean that ES
+// already has a newer version of the document. Updates are never versioned, a conflict means that
+// ES ran out of retries and the change was lost.
+func (r *BulkResponse) Failed(ignoreConflicts bool) []*BulkItem {
+	if !r.Errors {
+		return nil
+	}
+	var failed []*BulkItem
+	for _, item := range r.Items {
+		for action, result := range item {
+			if result.failed(action, ignoreConflicts) {
+				failed = append(failed, result)
+			}
+		}
+	}
+	return failed
+}
+
+// failed reports whether the item did not succeed and wasn't rejected, see BulkResponse.Failed.
+func (item *BulkItem) failed(action string, ignoreConflicts bool) bool {
+	// Deleting something that is already gone is fine.
+	if action == "delete" && item.Status == 404 && item.Error == nil {
+		return false
+	}
+	if ignoreConflicts && item.Status == http.StatusConflict && action != "update" {
+		return false
+	}
+	if item.Rejected() {
+		return false
+	}
+	return item.Error != nil || item.Status >= 300
+}
+
+// acknowledge tells the entries of b that weren't rejected how they went.
+func (r *BulkResponse) acknowledge(b *BulkBody, ignoreConflicts bool) {
+	for n, item := range r.Items {
+		for action, result := range item {
+			switch {
+			case result.Rejected():
+			case result.failed(action, ignoreConflicts):
+				b.acknowledge(n, BulkItemsFailed{[]*BulkItem{result}})
+			default:
+				b.acknowledge(n, nil)
+			}
+		}
+	}
+}
+
+// BulkItemsFailed is returned by BulkSend when the request succeeded but some of its items did not.
+type BulkItemsFailed struct {
+	Items []*BulkItem
+}
+
+func (e BulkItemsFailed) Error() string {
+	msg := fmt.Sprintf("%d bulk items failed", len(e.Items))
+	if len(e.Items) > 0 {
+		first := e.Items[0]
+		msg += fmt.Sprintf(", first %s/%s: %d", first.Index, first.Id, first.Status)
+		if first.Error != nil {
+			msg += " " + first.Error.Error()
+		}
+	}
+	return msg
+}
+
+// RequestFailed is returned by BulkSend when elasticsearch refused the request as a whole with a 4xx
+// status other than 429, such as for a malformed or unauthorized request. Every entry is acknowledged
+// with it and dropped.
+type RequestFailed struct {
+	Status int
+	Body   string
+}
+
+func (e RequestFailed) Error() string {
+	return fmt.Sprintf("Unexpected status code: %d\n%s", e.Status, e.Body)
+}
+
+// Rejected is returned by BulkSend when elasticsearch was too busy to handle some or all of the
+// entries. The rejected entries are left in the BulkBody to be sent again, other failures are listed
+// in Failed.
+type Rejected struct {
+	Entries int
+	Failed  []*BulkItem
+}
+
+func (e Rejected) Error() string {
+	msg := fmt.Sprintf("%d bulk entries rejected by elasticsearch", e.Entries)
+	if len(e.Failed) > 0 {
+		msg += ", " + BulkItemsFailed{e.Failed}.Error()
+	}
+	return msg
+}
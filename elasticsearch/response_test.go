@@ -0,0 +1,334 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBulkResponseFailed(t *testing.T) {
+	responses := map[string]string{
+		// Elasticsearch 1.x
+		"1.x": `{"took": 3, "errors": true, "items": [
+			{"index": {"_index": "testing", "_type": "user", "_id": "1", "status": 201}},
+			{"index": {"_index": "testing", "_type": "user", "_id": "2", "status": 400,
+				"error": "MapperParsingException[failed to parse [age]]"}},
+			{"delete": {"_index": "testing", "_type": "user", "_id": "3", "status": 404, "found": false}}
+		]}`,
+		// Elasticsearch 7 and later
+		"7.x": `{"took": 3, "errors": true, "items": [
+			{"index": {"_index": "testing", "_id": "1", "status": 201, "result": "created"}},
+			{"update": {"_index": "testing", "_id": "2", "status": 400,
+				"error": {"type": "mapper_parsing_exception", "reason": "failed to parse field [age]"}}},
+			{"delete": {"_index": "testing", "_id": "3", "status": 404, "result": "not_found"}}
+		]}`,
+	}
+	types := map[string]string{"1.x": "MapperParsingException", "7.x": "mapper_parsing_exception"}
+
+	for version, body := range responses {
+		var r BulkResponse
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatal(version, err)
+		}
+		failed := r.Failed(false)
+		if len(failed) != 1 {
+			t.Fatal(version, "expected one failed item, got", len(failed))
+		}
+		if failed[0].Id != "2" || failed[0].Error.Type != types[version] {
+			t.Errorf("%s: unexpected failure %+v %+v", version, failed[0], failed[0].Error)
+		}
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	responses := map[string]Version{
+		`{"version": {"number": "1.7.5"}}`:                                {Major: 1, Minor: 7},
+		`{"version": {"number": "8.11.1", "build_flavor": "default"}}`:    {Major: 8, Minor: 11},
+		`{"version": {"distribution": "opensearch", "number": "2.11.0"}}`: {Major: 2, Minor: 11, OpenSearch: true},
+	}
+	for body, valid := range responses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		v, err := NewClient([]string{server.URL}, 1).DetectVersion(context.Background())
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != valid {
+			t.Error("Expected", valid, "got", v)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	valid := map[string]Version{
+		"1.7":             {Major: 1, Minor: 7},
+		"8":               {Major: 8},
+		"7.10.2":          {Major: 7, Minor: 10},
+		"8.0-SNAPSHOT":    {Major: 8},
+		"opensearch-2.11": {Major: 2, Minor: 11, OpenSearch: true},
+	}
+	for s, version := range valid {
+		if v, err := ParseVersion(s); err != nil || v != version {
+			t.Error("Expected", s, "to parse as", version, "got", v, err)
+		}
+	}
+	if _, err := ParseVersion("latest"); err == nil {
+		t.Error("Expected an invalid version to fail")
+	}
+}
+
+func TestBulkResponseConflicts(t *testing.T) {
+	var r BulkResponse
+	body := `{"took": 3, "errors": true, "items": [
+		{"index": {"_index": "testing", "_id": "1", "status": 409,
+			"error": {"type": "version_conflict_engine_exception", "reason": "version conflict"}}},
+		{"update": {"_index": "testing", "_id": "2", "status": 409,
+			"error": {"type": "version_conflict_engine_exception", "reason": "version conflict"}}}
+	]}`
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Failed(false)) != 2 {
+		t.Error("Expected conflicts to fail without external versions")
+	}
+	if failed := r.Failed(true); len(failed) != 1 || failed[0].Id != "2" {
+		t.Error("Expected only update conflicts to fail with external versions:", failed)
+	}
+}
+
+func TestBulkResponseRejected(t *testing.T) {
+	responses := map[string]string{
+		"1.x": `{"took": 3, "errors": true, "items": [
+			{"index": {"_index": "testing", "_type": "user", "_id": "1", "status": 201}},
+			{"index": {"_index": "testing", "_type": "user", "_id": "2", "status": 429,
+				"error": "EsRejectedExecutionException[rejected execution (queue capacity 50)]"}},
+			{"index": {"_index": "testing", "_type": "user", "_id": "3", "status": 400,
+				"error": "MapperParsingException[failed to parse [age]]"}},
+			{"index": {"_index": "testing", "_type": "user", "_id": "4", "status": 429,
+				"error": "EsRejectedExecutionException[rejected execution (queue capacity 50)]"}}
+		]}`,
+		"7.x": `{"took": 3, "errors": true, "items": [
+			{"index": {"_index": "testing", "_id": "1", "status": 201, "result": "created"}},
+			{"index": {"_index": "testing", "_id": "2", "status": 429,
+				"error": {"type": "es_rejected_execution_exception", "reason": "rejected execution"}}},
+			{"index": {"_index": "testing", "_id": "3", "status": 400,
+				"error": {"type": "mapper_parsing_exception", "reason": "failed to parse field [age]"}}},
+			{"index": {"_index": "testing", "_id": "4", "status": 429,
+				"error": {"type": "es_rejected_execution_exception", "reason": "rejected execution"}}}
+		]}`,
+	}
+
+	for version, body := range responses {
+		var r BulkResponse
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatal(version, err)
+		}
+		if rejected := r.Rejected(); len(rejected) != 2 || rejected[0] != 1 || rejected[1] != 3 {
+			t.Error(version, "expected items 1 and 3 to be rejected, got", rejected)
+		}
+		if failed := r.Failed(false); len(failed) != 1 || failed[0].Id != "3" {
+			t.Error(version, "expected only item 3 to have failed, got", failed)
+		}
+	}
+}
+
+func TestBulkSendRejected(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			fmt.Fprint(w, `{"took": 1, "errors": true, "items": [
+				{"index": {"_index": "testing", "_id": "1", "status": 201}},
+				{"index": {"_index": "testing", "_id": "2", "status": 429,
+					"error": {"type": "es_rejected_execution_exception", "reason": "rejected execution"}}},
+				{"index": {"_index": "testing", "_id": "3", "status": 201}}
+			]}`)
+		default:
+			fmt.Fprint(w, `{"took": 1, "errors": false, "items": []}`)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient([]string{server.URL}, 1)
+	bulk := NewBulkBody(MB)
+	bulk.Options.Version = Version{Major: 7}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := bulk.Add(&rawEntry{"index", "testing", "user", id, map[string]interface{}{"id": id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := bulk.String()
+
+	if err, ok := c.BulkSend(context.Background(), bulk).(Rejected); !ok || err.Entries != 3 {
+		t.Fatal("Expected all entries to be rejected, got", err)
+	}
+	if bulk.String() != all+"\n" {
+		t.Error("Expected the body to be kept when the request is rejected, got", bulk.String())
+	}
+
+	if err, ok := c.BulkSend(context.Background(), bulk).(Rejected); !ok || err.Entries != 1 {
+		t.Fatal("Expected one entry to be rejected, got", err)
+	}
+	valid := `{"index":{"_index":"testing","_id":"2"}}
+{"id":"2"}
+`
+	if bulk.String() != valid || bulk.Entries() != 1 {
+		t.Errorf("\n'%s'\nNot equal to:\n'%s'", bulk.String(), valid)
+	}
+
+	if err := c.BulkSend(context.Background(), bulk); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.Len() != 0 {
+		t.Error("Expected the body to be reset after success")
+	}
+}
+
+func TestBulkSendFailed(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			fmt.Fprint(w, `{"took": 1, "errors": tr`)
+		default:
+			fmt.Fprint(w, `{"took": 1, "errors": false, "items": []}`)
+		}
+	}))
+
+	c := NewClient([]string{server.URL}, 1)
+	bulk := NewBulkBody(MB)
+	bulk.Options.Version = Version{Major: 7}
+	if err := bulk.Add(&rawEntry{"index", "testing", "user", "1", map[string]interface{}{"id": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 2; n++ {
+		if err := c.BulkSend(context.Background(), bulk); err == nil || bulk.Entries() != 1 {
+			t.Fatal(n, "expected the body to be kept when the request fails, got", err, bulk.Entries())
+		}
+	}
+	if err := c.BulkSend(context.Background(), bulk); err != nil || bulk.Len() != 0 {
+		t.Error("Expected the body to be reset after success, got", err, bulk.Len())
+	}
+
+	server.Close()
+	if err := bulk.Add(&rawEntry{"index", "testing", "user", "1", map[string]interface{}{"id": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BulkSend(context.Background(), bulk); err == nil || bulk.Entries() != 1 {
+		t.Error("Expected the body to be kept when the node can't be reached, got", err, bulk.Entries())
+	}
+}
+
+func TestBulkSendRefused(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "illegal_argument_exception"}`)
+	}))
+	defer server.Close()
+
+	c := NewClient([]string{server.URL}, 1)
+	bulk := NewBulkBody(MB)
+	bulk.Options.Version = Version{Major: 7}
+	entry := &ackedEntry{rawEntry: rawEntry{"index", "testing", "user", "1", map[string]interface{}{"id": "1"}}}
+	if err := bulk.Add(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.BulkSend(context.Background(), bulk)
+	if e, ok := err.(RequestFailed); !ok || e.Status != http.StatusBadRequest {
+		t.Fatal("Expected the request to be refused, got", err)
+	}
+	if bulk.Len() != 0 {
+		t.Error("Expected the refused body to be reset, got", bulk.Len())
+	}
+	if entry.acked != 1 || entry.err != err {
+		t.Error("Expected the entry to be acknowledged with the error, got", entry.acked, entry.err)
+	}
+	if requests != 1 {
+		t.Error("Expected a single request, got", requests)
+	}
+}
+
+// ackedEntry remembers how it was acknowledged.
+type ackedEntry struct {
+	rawEntry
+	acked int
+	err   error
+}
+
+func (a *ackedEntry) Acknowledge(err error) {
+	a.acked++
+	a.err = err
+}
+
+func TestBulkSendAcknowledge(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			fmt.Fprint(w, `{"took": 1, "errors": true, "items": [
+				{"index": {"_index": "testing", "_id": "1", "status": 201}},
+				{"index": {"_index": "testing", "_id": "2", "status": 429,
+					"error": {"type": "es_rejected_execution_exception", "reason": "rejected execution"}}},
+				{"index": {"_index": "testing", "_id": "3", "status": 400,
+					"error": {"type": "mapper_parsing_exception", "reason": "failed to parse"}}}
+			]}`)
+		default:
+			fmt.Fprint(w, `{"took": 1, "errors": false, "items": [
+				{"index": {"_index": "testing", "_id": "2", "status": 201}}
+			]}`)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient([]string{server.URL}, 1)
+	bulk := NewBulkBody(MB)
+	bulk.Options.Version = Version{Major: 7}
+	var entries []*ackedEntry
+	for _, id := range []string{"1", "2", "3"} {
+		entry := &ackedEntry{rawEntry: rawEntry{"index", "testing", "user", id, map[string]interface{}{"id": id}}}
+		entries = append(entries, entry)
+		if err := bulk.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty := &ackedEntry{rawEntry: rawEntry{"update", "testing", "user", "4", nil}}
+	if err := bulk.Add(empty); err != nil || empty.acked != 1 || empty.err != nil {
+		t.Error("Expected an entry with nothing to send to be acknowledged when added:", err, empty.acked, empty.err)
+	}
+
+	if _, ok := c.BulkSend(context.Background(), bulk).(Rejected); !ok {
+		t.Fatal("Expected an entry to be rejected")
+	}
+	if entries[0].acked != 1 || entries[0].err != nil {
+		t.Error("Expected the written entry to be acknowledged:", entries[0].acked, entries[0].err)
+	}
+	if entries[1].acked != 0 {
+		t.Error("Expected the rejected entry not to be acknowledged yet")
+	}
+	if entries[2].acked != 1 || entries[2].err == nil {
+		t.Error("Expected the failed entry to be acknowledged with its error:", entries[2].acked, entries[2].err)
+	}
+
+	if err := c.BulkSend(context.Background(), bulk); err != nil {
+		t.Fatal(err)
+	}
+	if entries[1].acked != 1 || entries[1].err != nil || entries[0].acked != 1 {
+		t.Error("Expected the retained entry to be acknowledged once sent:", entries[1].acked, entries[1].err)
+	}
+}
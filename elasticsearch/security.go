@@ -0,0 +1,79 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Credentials are added to every request sent by a Client. Only one kind should be set, an API key
+// takes precedence over a bearer token which takes precedence over basic auth.
+type Credentials struct {
+	Username string
+	Password string
+
+	// APIKey is either the base64 encoded key returned by elasticsearch or id:key.
+	APIKey string
+
+	BearerToken string
+}
+
+// apply sets the Authorization header of the request.
+func (c *Credentials) apply(req *http.Request) {
+	switch {
+	case c == nil:
+	case c.APIKey != "":
+		key := c.APIKey
+		if strings.Contains(key, ":") {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		req.Header.Set("Authorization", "ApiKey "+key)
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// TLSConfig returns the configuration for talking to nodes over https. caFile is a PEM bundle of
+// authorities to trust instead of the system ones, certFile and keyFile is the client certificate
+// used for mutual TLS. All files are optional. insecure turns off verification of the node
+// certificates and should only be used for testing.
+func TLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("Both a client certificate and key is needed")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// UseTLS sets the configuration used for https nodes, it should be called before sending requests.
+func (c *Client) UseTLS(config *tls.Config) {
+	if tr, ok := c.Transport.(*http.Transport); ok {
+		tr.TLSClientConfig = config
+	}
+}
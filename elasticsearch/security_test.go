@@ -0,0 +1,85 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		credentials *Credentials
+		header      string
+	}{
+		{nil, ""},
+		{&Credentials{Username: "river", Password: "secret"}, "Basic cml2ZXI6c2VjcmV0"},
+		{&Credentials{APIKey: "id:key"}, "ApiKey aWQ6a2V5"},
+		{&Credentials{APIKey: "aWQ6a2V5", Username: "river"}, "ApiKey aWQ6a2V5"},
+		{&Credentials{BearerToken: "token"}, "Bearer token"},
+	}
+	for _, test := range tests {
+		var header string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Get("Authorization")
+		}))
+		c := NewClient([]string{server.URL}, 1)
+		c.Credentials = test.credentials
+		resp, err := c.Do(context.Background(), "GET", "/", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if header != test.header {
+			t.Errorf("Expected Authorization %q, got %q", test.header, header)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cryriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient([]string{server.URL}, 1)
+	if _, err := c.Do(context.Background(), "GET", "/", "", nil); err == nil {
+		t.Error("Expected an unknown authority to fail")
+	}
+
+	for _, insecure := range []bool{false, true} {
+		caPath := caFile
+		if insecure {
+			caPath = ""
+		}
+		config, err := TLSConfig(caPath, "", "", insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient([]string{server.URL}, 1)
+		c.UseTLS(config)
+		resp, err := c.Do(context.Background(), "GET", "/", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if _, err := TLSConfig("", filepath.Join(dir, "cert.pem"), "", false); err == nil {
+		t.Error("Expected a client certificate without key to fail")
+	}
+}
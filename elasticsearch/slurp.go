@@ -2,15 +2,25 @@
 package elasticsearch
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"github.com/duego/cryriver/stats"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// How long to wait before sending a request that failed as a whole again, doubled for each
+	// failure in a row.
+	failedBackoff = time.Second
+	// The longest wait before sending a failed request again.
+	maxFailedBackoff = time.Minute
+)
+
 type Timestamper interface {
 	Time() *time.Time
 }
@@ -30,6 +40,12 @@ type Operationer interface {
 	Action() (string, error)
 }
 
+// Contexter can be implemented by a Transaction to carry the trace span it is part of, the bulk
+// request sending it links to that span.
+type Contexter interface {
+	Context() context.Context
+}
+
 // Transaction as in one complete set of values to perform an operation towards elasticsearch.
 type Transaction interface {
 	Operationer
@@ -38,89 +54,254 @@ type Transaction interface {
 	Timestamper
 }
 
+// The most documents a Coalescer holds before they are added to the bulk buffer.
+const maxCoalesced = 10000
+
+// FlushLimits decides when Slurp sends the operations it has collected. Whichever limit is reached
+// first triggers the request, a zero MaxOps or MaxAge disables that limit.
+type FlushLimits struct {
+	// MaxBytes is the size a bulk request may grow to.
+	MaxBytes ByteSize
+
+	// MaxOps is the most operations to send in one bulk request.
+	MaxOps int
+
+	// MaxAge is the longest an operation waits before being sent.
+	MaxAge time.Duration
+}
+
+// DefaultFlushLimits sends bulk requests of at most a megabyte, at least once per second.
+var DefaultFlushLimits = FlushLimits{MaxBytes: MB, MaxAge: time.Second}
+
 type BulkSender interface {
-	BulkSend(*BulkBody) error
+	BulkSend(context.Context, *BulkBody) error
 }
 
-// Client is used for sending the actual requests to elasticsearch.
-type Client struct {
-	*http.Client
-	url string
+// Slurp collects transactions that will be sent towards elasticsearch in batches.
+// Closing the channel will make the function return. Any pending transactions will be flushed before
+// returning. Once ctx is done, Slurp returns right away dropping what it has collected, and any
+// request being sent is cancelled. Requests are limited by the throttle, which may be shared between slurpers and nil, and
+// entries rejected by elasticsearch are sent again once the throttle allows it. The flusher, which
+// may also be shared and nil, sends collected transactions on demand. Each bulk request is logged
+// with a batch id, a nil logger uses slog.Default().
+func Slurp(ctx context.Context, client BulkSender, esc chan Transaction, options BulkOptions, limits FlushLimits, throttle *Throttle, flusher *Flusher, logger *slog.Logger) {
+	slurp(ctx, client, esc, options, limits, throttle, flusher, logger, nil)
 }
 
-func NewClient(url string, maxConn int) *Client {
-	tr := &http.Transport{
-		MaxIdleConnsPerHost: maxConn,
-	}
-	return &Client{
-		&http.Client{Transport: tr},
-		url,
+// Identifies bulk requests in logs and traces.
+var batches uint64
+
+// Spans are sent to the global tracer provider, nothing is recorded unless one has been set.
+var tracer = otel.Tracer("github.com/duego/cryriver/elasticsearch")
+
+// slurp is Slurp that also returns, after flushing, when stop is closed.
+func slurp(ctx context.Context, client BulkSender, esc chan Transaction, options BulkOptions, limits FlushLimits, throttle *Throttle, flusher *Flusher, logger *slog.Logger, stop chan bool) {
+	if logger == nil {
+		logger = slog.Default()
 	}
-}
+	defer logger.Debug("Slurper stopped")
 
-// BulkSend will accept a populated BulkBody that will be sent using POST.
-// If the Post doesn't return any errors, the BulkBody will be Reset to accept new operations.
-// Will return an error on non-200 return codes.
-func (c Client) BulkSend(b *BulkBody) error {
-	b.Done()
-	log.Println("Send that buffer!", string(b.Bytes()))
-	resp, err := c.Post(c.url, "application/x-www-form-urlencoded", b)
-	if err != nil {
-		return err
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultFlushLimits.MaxBytes
 	}
-	defer resp.Body.Close()
-	b.Reset()
+	bulkBuf := NewBulkBody(limits.MaxBytes)
+	bulkBuf.Options = options
+	defer bulkBuf.Release()
 
-	// XXX: Do we really need to iterate all items returned to see if all has ok: true?
-	if code := resp.StatusCode; code != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(body)))
+	var pending *Coalescer
+	if options.Coalesce {
+		pending = NewCoalescer()
 	}
-	return nil
-}
 
-// Slurp collects transactions that will be sent towards elasticsearch in batches.
-// Closing the channel will make the function return. Any pending transactions will be flushed before
-// returning.
-func Slurp(client BulkSender, esc chan Transaction) {
-	defer log.Println("Slurper stopped")
+	// The age timer runs from the first operation collected after a flush, so a flush for any reason
+	// gives the next batch the full MaxAge to fill up.
+	var ageTimer *time.Timer
+	var age <-chan time.Time
+	stopAge := func() {
+		if ageTimer != nil {
+			ageTimer.Stop()
+			ageTimer, age = nil, nil
+		}
+	}
+	startAge := func() {
+		if ageTimer == nil && limits.MaxAge > 0 {
+			ageTimer = time.NewTimer(limits.MaxAge)
+			age = ageTimer.C
+		}
+	}
+	// send the buffer, trigger tells what caused it for metrics.
+	send := func(trigger string) {
+		stopAge()
+		if bulkBuf.Len() == 0 {
+			return
+		}
+		stats.BulkFlushes.Inc(trigger)
+		id := atomic.AddUint64(&batches, 1)
+		batch := logger.With("batch", id)
+		// The batch span links to the operations in it, each request sent for it is a child span.
+		ctx, span := tracer.Start(ctx, "bulk",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithLinks(bulkBuf.Links()...),
+			trace.WithAttributes(
+				attribute.Int64("batch", int64(id)),
+				attribute.String("trigger", trigger),
+				attribute.Int("entries", bulkBuf.Entries()),
+			))
+		defer span.End()
+		var backoff time.Duration
+		for bulkBuf.Len() > 0 {
+			entries := bulkBuf.Entries()
+			_, request := tracer.Start(ctx, "send", trace.WithAttributes(
+				attribute.Int("entries", entries),
+				attribute.Int("bytes", bulkBuf.Len()),
+			))
+			if err := throttle.Acquire(ctx); err != nil {
+				batch.Warn("Bulk request cancelled", "entries", entries, "err", err)
+				request.RecordError(err)
+				request.End()
+				bulkBuf.Reset()
+				break
+			}
+			start := time.Now()
+			err := client.BulkSend(ctx, bulkBuf)
+			r, rejected := err.(Rejected)
+			_, refused := err.(RequestFailed)
+			throttle.Release(rejected)
+			// The body is only kept when the request failed as a whole.
+			failed := err != nil && !rejected && bulkBuf.Len() > 0
+			if failed {
+				if backoff == 0 {
+					backoff = failedBackoff
+				} else if backoff *= 2; backoff > maxFailedBackoff {
+					backoff = maxFailedBackoff
+				}
+			}
+			switch {
+			case rejected:
+				batch.Warn("Bulk request rejected, sending again", "entries", entries, "rejected", r.Entries, "err", err)
+				request.SetAttributes(attribute.Int("rejected", r.Entries))
+			case failed:
+				batch.Error("Bulk request failed, sending again", "entries", entries, "in", backoff, "err", err)
+			case refused:
+				batch.Error("Bulk request refused, dropping it", "entries", entries, "err", err)
+				span.SetStatus(codes.Error, err.Error())
+			case err != nil:
+				batch.Error("Bulk items failed", "entries", entries, "err", err)
+				span.SetStatus(codes.Error, err.Error())
+			default:
+				batch.Debug("Bulk request sent", "entries", entries, "trigger", trigger, "duration", time.Since(start))
+			}
+			if err != nil {
+				request.RecordError(err)
+				request.SetStatus(codes.Error, err.Error())
+			}
+			request.End()
+			switch {
+			case rejected:
+				stats.BulkRetries.Add(float64(r.Entries))
+			case failed:
+				stats.BulkRetries.Add(float64(entries))
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+				}
+			default:
+				return
+			}
+		}
+	}
 
-	bulkBuf := NewBulkBody(MB)
-	bulkTicker := time.NewTicker(time.Second)
+	// skip drops an operation that can't be sent.
+	skip := func(op Transaction, err error) {
+		index, _ := op.Index()
+		id, _ := op.Id()
+		logger.Error("Skipping operation", "index", index, "_id", id, "err", err)
+		if a, ok := op.(Acknowledger); ok {
+			a.Acknowledge(err)
+		}
+	}
+	// A full buffer is sent before adding the operation again, keeping operations in order.
+	add := func(op Transaction) {
+		// Batches shrink while elasticsearch is rejecting requests.
+		if max := throttle.MaxBytes(); max > 0 && max < limits.MaxBytes {
+			bulkBuf.SetMax(max)
+		} else {
+			bulkBuf.SetMax(limits.MaxBytes)
+		}
+		for {
+			err := bulkBuf.Add(op)
+			if err != BulkBodyFull {
+				if err != nil {
+					skip(op, err)
+				}
+				return
+			}
+			stats.BulkFull.Add(1)
+			send("size")
+		}
+	}
+	// Coalesced transactions are added to the bulk buffer just before sending it.
+	addPending := func() {
+		if pending == nil {
+			return
+		}
+		for _, op := range pending.Drain() {
+			add(op)
+		}
+	}
+	collected := func() int {
+		n := bulkBuf.Entries()
+		if pending != nil {
+			n += pending.Len()
+		}
+		return n
+	}
 
 	// Loop all incoming operations and send them to the bulk indexer.
+	flush := flusher.wait()
 	for {
 		select {
 		case op := <-esc:
 			if op == nil {
-				if bulkBuf.Len() > 0 {
-					if err := client.BulkSend(bulkBuf); err != nil {
-						log.Println(err)
-					}
-				}
+				addPending()
+				send("close")
 				return
 			}
-			err := bulkBuf.Add(op)
-			switch err {
-			case nil:
-			case BulkBodyFull:
-				stats.BulkFull.Add(1)
-				if err := client.BulkSend(bulkBuf); err != nil {
-					log.Println(err)
-					// XXX: There is no limit on the amount of pending go routines doing it like this
-					// but at least we won't block
-					go func() { esc <- op }()
+			if pending == nil {
+				add(op)
+			} else {
+				if err := pending.Add(op); err != nil {
+					skip(op, err)
 				}
-			default:
-				log.Println(err)
-			}
-		case <-bulkTicker.C:
-			if bulkBuf.Len() > 0 {
-				stats.BulkTime.Add(1)
-				if err := client.BulkSend(bulkBuf); err != nil {
-					log.Println(err)
+				if pending.Len() >= maxCoalesced {
+					addPending()
 				}
 			}
+			if collected() > 0 {
+				startAge()
+			}
+			if limits.MaxOps > 0 && collected() >= limits.MaxOps {
+				stats.BulkOps.Add(1)
+				addPending()
+				send("ops")
+			}
+		case <-age:
+			stats.BulkTime.Add(1)
+			addPending()
+			send("age")
+		case <-flush:
+			flush = flusher.wait()
+			addPending()
+			send("flush")
+		case <-stop:
+			addPending()
+			send("close")
+			return
+		case <-ctx.Done():
+			logger.Warn("Slurper cancelled", "dropped", collected(), "err", ctx.Err())
+			return
 		}
 	}
 }
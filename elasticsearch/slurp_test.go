@@ -0,0 +1,208 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSender remembers how many entries each bulk request had.
+type recordingSender struct {
+	sent chan int
+}
+
+func (r *recordingSender) BulkSend(ctx context.Context, b *BulkBody) error {
+	r.sent <- b.Entries()
+	b.Reset()
+	return nil
+}
+
+func slurpEntries(limits FlushLimits, n int) (*recordingSender, chan Transaction, chan bool) {
+	sender := &recordingSender{make(chan int, n)}
+	esc := make(chan Transaction)
+	done := make(chan bool)
+	go func() {
+		Slurp(context.Background(), sender, esc, BulkOptions{}, limits, nil, nil, nil)
+		close(done)
+	}()
+	for i := 0; i < n; i++ {
+		esc <- entryAt("index", strconv.Itoa(i), 1, map[string]interface{}{"a": i})
+	}
+	return sender, esc, done
+}
+
+func TestSlurpMaxOps(t *testing.T) {
+	sender, esc, done := slurpEntries(FlushLimits{MaxOps: 2}, 5)
+	close(esc)
+	<-done
+	close(sender.sent)
+
+	var batches []int
+	for n := range sender.sent {
+		batches = append(batches, n)
+	}
+	if len(batches) != 3 || batches[0] != 2 || batches[1] != 2 || batches[2] != 1 {
+		t.Error("Expected batches of 2, 2 and 1 operations, got", batches)
+	}
+}
+
+func TestSlurpMaxAge(t *testing.T) {
+	sender, esc, done := slurpEntries(FlushLimits{MaxAge: 100 * time.Millisecond}, 3)
+	defer func() {
+		close(esc)
+		<-done
+	}()
+
+	select {
+	case n := <-sender.sent:
+		if n != 3 {
+			t.Error("Expected 3 operations to be sent, got", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Operations were not sent after MaxAge")
+	}
+
+	// Nothing is pending, so no more requests should be made.
+	select {
+	case n := <-sender.sent:
+		t.Error("Unexpected request with", n, "operations")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSlurpFlush(t *testing.T) {
+	sender := &recordingSender{make(chan int, 2)}
+	flusher := NewFlusher()
+	var escs []chan Transaction
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		esc := make(chan Transaction)
+		escs = append(escs, esc)
+		go func() {
+			Slurp(context.Background(), sender, esc, BulkOptions{}, FlushLimits{MaxAge: time.Hour}, nil, flusher, nil)
+			done <- true
+		}()
+		esc <- entryAt("index", strconv.Itoa(i), 1, map[string]interface{}{"a": i})
+	}
+	defer func() {
+		for _, esc := range escs {
+			close(esc)
+			<-done
+		}
+	}()
+
+	flusher.Flush()
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-sender.sent:
+			if n != 1 {
+				t.Error("Expected 1 operation to be sent, got", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected every slurper to send on Flush")
+		}
+	}
+}
+
+func TestSlurpCancel(t *testing.T) {
+	sender := &recordingSender{make(chan int, 1)}
+	esc := make(chan Transaction)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		Slurp(ctx, sender, esc, BulkOptions{}, FlushLimits{MaxAge: time.Hour}, nil, nil, nil)
+		close(done)
+	}()
+	esc <- entryAt("index", "1", 1, map[string]interface{}{"a": 1})
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Slurp to return when cancelled")
+	}
+	select {
+	case n := <-sender.sent:
+		t.Error("Expected nothing to be sent once cancelled, got", n, "operations")
+	default:
+	}
+}
+
+// orderSender remembers the ids in the order they were sent.
+type orderSender struct {
+	ids []string
+}
+
+func (o *orderSender) BulkSend(ctx context.Context, b *BulkBody) error {
+	for _, line := range strings.Split(b.String(), "\n") {
+		if i := strings.Index(line, `"_id":"`); i >= 0 {
+			id := line[i+len(`"_id":"`):]
+			o.ids = append(o.ids, id[:strings.Index(id, `"`)])
+		}
+	}
+	b.Reset()
+	return nil
+}
+
+func TestSlurpFullKeepsOrder(t *testing.T) {
+	sender := &orderSender{}
+	esc := make(chan Transaction)
+	done := make(chan bool)
+	go func() {
+		Slurp(context.Background(), sender, esc, BulkOptions{}, FlushLimits{MaxBytes: 150}, nil, nil, nil)
+		close(done)
+	}()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		id := strconv.Itoa(i)
+		expected = append(expected, id)
+		esc <- entryAt("index", id, 1, map[string]interface{}{"a": i})
+	}
+	close(esc)
+	<-done
+
+	if strings.Join(sender.ids, ",") != strings.Join(expected, ",") {
+		t.Error("Expected operations in order", expected, "got", sender.ids)
+	}
+}
+
+// failingSender fails the first request as a whole, keeping the body like the client does.
+type failingSender struct {
+	recordingSender
+	failed bool
+}
+
+func (f *failingSender) BulkSend(ctx context.Context, b *BulkBody) error {
+	if !f.failed {
+		f.failed = true
+		f.sent <- b.Entries()
+		return errors.New("Unexpected status code: 503")
+	}
+	return f.recordingSender.BulkSend(ctx, b)
+}
+
+func TestSlurpRetriesFailed(t *testing.T) {
+	sender := &failingSender{recordingSender: recordingSender{make(chan int, 2)}}
+	esc := make(chan Transaction)
+	done := make(chan bool)
+	go func() {
+		Slurp(context.Background(), sender, esc, BulkOptions{}, FlushLimits{MaxOps: 2}, nil, nil, nil)
+		close(done)
+	}()
+	esc <- entryAt("index", "1", 1, map[string]interface{}{"a": 1})
+	esc <- entryAt("index", "2", 1, map[string]interface{}{"a": 2})
+	close(esc)
+	<-done
+	close(sender.sent)
+
+	var batches []int
+	for n := range sender.sent {
+		batches = append(batches, n)
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 2 {
+		t.Error("Expected the failed batch to be sent again, got", batches)
+	}
+}
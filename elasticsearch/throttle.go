@@ -0,0 +1,185 @@
+package elasticsearch
+
+import (
+	"context"
+	"github.com/duego/cryriver/stats"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to pause after the first rejection, doubled for each rejection in a row.
+	rejectedBackoff = 500 * time.Millisecond
+	// The longest pause after rejections.
+	maxRejectedBackoff = 30 * time.Second
+	// The smallest bulk requests are shrunk to.
+	minThrottledBytes = 64 * KB
+)
+
+// Throttle adapts the number of simultaneous bulk requests and their size to what elasticsearch can
+// take. Each rejection halves both and pauses sending for a while, each accepted request adds back
+// one request and a tenth of the size, up to the configured limits.
+//
+// A nil Throttle doesn't limit anything.
+type Throttle struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	maxRequests int
+	maxBytes    ByteSize
+	requests    int
+	bytes       ByteSize
+	inflight    int
+	backoff     time.Duration
+	pausedUntil time.Time
+}
+
+// NewThrottle returns a Throttle allowing at most requests simultaneous bulk requests of maxBytes.
+func NewThrottle(requests int, maxBytes ByteSize) *Throttle {
+	if requests < 1 {
+		requests = 1
+	}
+	t := &Throttle{
+		maxRequests: requests,
+		maxBytes:    maxBytes,
+		requests:    requests,
+		bytes:       maxBytes,
+	}
+	t.cond = sync.NewCond(&t.mu)
+	t.updateStats()
+	return t
+}
+
+// Acquire waits until sending is not paused and there is room for another request. Every Acquire
+// that returns nil must be followed by a Release, an error is returned if ctx is done first.
+func (t *Throttle) Acquire(ctx context.Context) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	// Waiting on the condition is interrupted when ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.cond.Broadcast()
+	})
+	defer stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if wait := t.pausedUntil.Sub(time.Now()); wait > 0 {
+			t.mu.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			t.mu.Lock()
+			continue
+		}
+		if t.inflight < t.requests {
+			break
+		}
+		t.cond.Wait()
+	}
+	t.inflight++
+	return nil
+}
+
+// Release finishes a request started with Acquire, rejected tells if elasticsearch was too busy to
+// handle it.
+func (t *Throttle) Release(rejected bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight--
+	if rejected {
+		stats.BulkRejected.Add(1)
+		stats.BulkRejections.Inc()
+		t.requests = t.requests / 2
+		if t.requests < 1 {
+			t.requests = 1
+		}
+		t.bytes = t.bytes / 2
+		if min := minThrottledBytes; t.bytes < min {
+			if min > t.maxBytes {
+				min = t.maxBytes
+			}
+			t.bytes = min
+		}
+		if t.backoff == 0 {
+			t.backoff = rejectedBackoff
+		} else if t.backoff < maxRejectedBackoff {
+			t.backoff *= 2
+			if t.backoff > maxRejectedBackoff {
+				t.backoff = maxRejectedBackoff
+			}
+		}
+		t.pausedUntil = time.Now().Add(t.backoff)
+	} else {
+		t.backoff = 0
+		if t.requests < t.maxRequests {
+			t.requests++
+		}
+		if t.bytes += t.maxBytes / 10; t.bytes > t.maxBytes {
+			t.bytes = t.maxBytes
+		}
+	}
+	t.updateStats()
+	t.cond.Broadcast()
+}
+
+// Wait blocks while sending is paused after a rejection. Returns the error of ctx if it's done first.
+func (t *Throttle) Wait(ctx context.Context) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	for {
+		t.mu.Lock()
+		wait := t.pausedUntil.Sub(time.Now())
+		t.mu.Unlock()
+		if wait <= 0 {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Requests returns how many simultaneous bulk requests are currently allowed, or 0 without a
+// Throttle.
+func (t *Throttle) Requests() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requests
+}
+
+// MaxBytes returns how large bulk requests may currently be, or 0 without a Throttle.
+func (t *Throttle) MaxBytes() ByteSize {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes
+}
+
+func (t *Throttle) updateStats() {
+	stats.BulkRequests.Set(int64(t.requests))
+	stats.BulkMaxBytes.Set(int64(t.bytes))
+	stats.BulkRequestsAllowed.Set(float64(t.requests))
+	stats.BulkMaxBytesAllowed.Set(float64(t.bytes))
+}
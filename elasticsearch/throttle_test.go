@@ -0,0 +1,94 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleAIMD(t *testing.T) {
+	throttle := NewThrottle(8, MB)
+	ctx := context.Background()
+
+	throttle.Acquire(ctx)
+	throttle.Release(true)
+	if r := throttle.Requests(); r != 4 {
+		t.Error("Expected requests to be halved to 4, got", r)
+	}
+	if b := throttle.MaxBytes(); b != MB/2 {
+		t.Error("Expected max bytes to be halved, got", b)
+	}
+	if throttle.Wait(ctx); time.Now().Before(throttle.pausedUntil) {
+		t.Error("Expected Wait to block until the pause is over")
+	}
+
+	for i := 0; i < 10; i++ {
+		throttle.Acquire(ctx)
+		throttle.Release(false)
+	}
+	if r := throttle.Requests(); r != 8 {
+		t.Error("Expected requests to recover to 8, got", r)
+	}
+	if b := throttle.MaxBytes(); b != MB {
+		t.Error("Expected max bytes to recover, got", b)
+	}
+}
+
+func TestThrottleLimitsRequests(t *testing.T) {
+	throttle := NewThrottle(1, MB)
+	ctx := context.Background()
+	throttle.Acquire(ctx)
+	acquired := make(chan bool)
+	go func() {
+		throttle.Acquire(ctx)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected a second request to wait for the first")
+	case <-time.After(20 * time.Millisecond):
+	}
+	throttle.Release(false)
+	<-acquired
+	throttle.Release(false)
+}
+
+func TestThrottleAcquireCancel(t *testing.T) {
+	throttle := NewThrottle(1, MB)
+	throttle.Acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan error)
+	go func() {
+		acquired <- throttle.Acquire(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-acquired:
+		if err != context.Canceled {
+			t.Error("Expected Acquire to return the error of the context, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Acquire to stop waiting when the context is cancelled")
+	}
+}
+
+func TestThrottleWaitCancel(t *testing.T) {
+	throttle := NewThrottle(1, MB)
+	throttle.Acquire(context.Background())
+	throttle.Release(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := throttle.Wait(ctx); err != context.Canceled {
+		t.Error("Expected Wait to return the error of the context, got", err)
+	}
+}
+
+func TestThrottleNil(t *testing.T) {
+	var throttle *Throttle
+	ctx := context.Background()
+	throttle.Acquire(ctx)
+	throttle.Release(true)
+	if throttle.Wait(ctx) != nil || throttle.MaxBytes() != 0 {
+		t.Error("Expected a nil Throttle to not limit anything")
+	}
+}
@@ -0,0 +1,93 @@
+package elasticsearch
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
+	"testing"
+)
+
+// Spans of all tests end up here, the global provider can only be set once for the package tracer.
+var spans = tracetest.NewSpanRecorder()
+
+func init() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+}
+
+// tracedEntry carries the span of the operation it came from.
+type tracedEntry struct {
+	*timedEntry
+	ctx context.Context
+}
+
+func (e *tracedEntry) Context() context.Context {
+	return e.ctx
+}
+
+func TestSlurpLinksOperations(t *testing.T) {
+	before := len(spans.Ended())
+	sender := &recordingSender{make(chan int, 1)}
+	esc := make(chan Transaction)
+	done := make(chan bool)
+	go func() {
+		Slurp(context.Background(), sender, esc, BulkOptions{}, FlushLimits{}, nil, nil, nil)
+		close(done)
+	}()
+
+	var operations []sdktrace.ReadOnlySpan
+	for i := 0; i < 3; i++ {
+		ctx, span := otel.Tracer("test").Start(context.Background(), "operation")
+		esc <- &tracedEntry{entryAt("index", strconv.Itoa(i), 1, map[string]interface{}{"a": i}), ctx}
+		span.End()
+		operations = append(operations, spans.Ended()[len(spans.Ended())-1])
+	}
+	close(esc)
+	<-done
+
+	var bulk, send sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended()[before:] {
+		switch s.Name() {
+		case "bulk":
+			bulk = s
+		case "send":
+			send = s
+		}
+	}
+	if bulk == nil || send == nil {
+		t.Fatal("Expected a bulk and a send span")
+	}
+	if send.Parent().SpanID() != bulk.SpanContext().SpanID() {
+		t.Error("Expected the request to be a child of the bulk span")
+	}
+	links := bulk.Links()
+	if len(links) != len(operations) {
+		t.Fatal("Expected links to", len(operations), "operations, got", len(links))
+	}
+	for i, op := range operations {
+		if links[i].SpanContext.SpanID() != op.SpanContext().SpanID() {
+			t.Error("Expected link", i, "to the span of operation", i)
+		}
+	}
+}
+
+func TestBulkBodyRetainLinks(t *testing.T) {
+	bulk := NewBulkBody(MB)
+	defer bulk.Release()
+	var contexts []context.Context
+	for i := 0; i < 3; i++ {
+		ctx, span := otel.Tracer("test").Start(context.Background(), "operation")
+		span.End()
+		contexts = append(contexts, ctx)
+		if err := bulk.Add(&tracedEntry{entryAt("index", strconv.Itoa(i), 1, map[string]interface{}{"a": i}), ctx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bulk.Retain([]int{1})
+	links := bulk.Links()
+	if len(links) != 1 || !links[0].SpanContext.Equal(trace.SpanContextFromContext(contexts[1])) {
+		t.Error("Expected only the link of the retained entry, got", links)
+	}
+}
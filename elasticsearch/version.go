@@ -0,0 +1,83 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Version is the release of the cluster being indexed to, it decides the format of bulk requests.
+// The zero Version is treated as an old elasticsearch using mapping types.
+type Version struct {
+	Major      int
+	Minor      int
+	OpenSearch bool
+}
+
+// ParseVersion reads versions like "1.7", "7.10.2" or "opensearch-2.11".
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	if strings.HasPrefix(s, "opensearch-") {
+		v.OpenSearch = true
+		s = strings.TrimPrefix(s, "opensearch-")
+	}
+	parts := strings.SplitN(s, ".", 3)
+	var err error
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("Invalid version %q", s)
+	}
+	if len(parts) > 1 {
+		// Ignore suffixes such as "0-SNAPSHOT"
+		minor := strings.SplitN(parts[1], "-", 2)[0]
+		if v.Minor, err = strconv.Atoi(minor); err != nil {
+			return v, fmt.Errorf("Invalid version %q", s)
+		}
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	if v.OpenSearch {
+		return fmt.Sprintf("opensearch-%d.%d", v.Major, v.Minor)
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// legacy reports whether the cluster uses mapping types and underscore prefixed bulk metadata such
+// as _routing, which was the case up until elasticsearch 7.
+func (v Version) legacy() bool {
+	return !v.OpenSearch && v.Major < 7
+}
+
+// requireAlias reports whether the require_alias bulk parameter is supported.
+func (v Version) requireAlias() bool {
+	return v.OpenSearch || v.Major > 7 || (v.Major == 7 && v.Minor >= 10)
+}
+
+// DetectVersion asks the cluster what version it is running.
+func (c *Client) DetectVersion(ctx context.Context) (Version, error) {
+	resp, err := c.Do(ctx, "GET", "/", "", nil)
+	if err != nil {
+		return Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Version{}, fmt.Errorf("Unexpected status code detecting version: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return Version{}, err
+	}
+	v, err := ParseVersion(info.Version.Number)
+	v.OpenSearch = info.Version.Distribution == "opensearch"
+	return v, err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duego/cryriver/elasticsearch"
+	"github.com/duego/cryriver/mongodb"
+	"github.com/duego/cryriver/stats"
+	"labix.org/v2/mgo"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCountedOps is how many operations behind are counted at most, unless maxLagOps needs more. They
+// are counted by reading the oplog after what elasticsearch has acknowledged.
+const maxCountedOps = 10000
+
+// health measures the replication lag and keeps track of when MongoDB and elasticsearch last
+// responded, to tell if the river is healthy and ready.
+type health struct {
+	maxLag         time.Duration
+	maxLagOps      int
+	maxUnreachable time.Duration
+	logger         *slog.Logger
+
+	mu       sync.Mutex
+	measured bool
+	lag      time.Duration
+	lagOps   int
+	mongoOK  time.Time
+	esOK     time.Time
+}
+
+func newHealth(maxLag time.Duration, maxLagOps int, maxUnreachable time.Duration, logger *slog.Logger) *health {
+	now := time.Now()
+	h := &health{
+		maxLag:         maxLag,
+		maxLagOps:      maxLagOps,
+		maxUnreachable: maxUnreachable,
+		logger:         logger,
+		mongoOK:        now,
+		esOK:           now,
+	}
+	stats.LagSeconds.Func(func() float64 {
+		if lag, _, ok := h.Lag(); ok {
+			return lag.Seconds()
+		}
+		return math.NaN()
+	})
+	stats.LagOperations.Func(func() float64 {
+		if _, ops, ok := h.Lag(); ok {
+			return float64(ops)
+		}
+		return math.NaN()
+	})
+	return h
+}
+
+// Lag returns how far what elasticsearch acknowledged is behind the primary, in time and in
+// operations on the namespace, counted up to countLimit. Not ok until measured and while an initial
+// import is running.
+func (h *health) Lag() (lag time.Duration, ops int, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lag, h.lagOps, h.measured
+}
+
+// countLimit returns how many operations behind are counted at most, maxCountedOps or one more than
+// maxLagOps to tell when it is exceeded.
+func (h *health) countLimit() int {
+	if h.maxLagOps >= maxCountedOps {
+		return h.maxLagOps + 1
+	}
+	return maxCountedOps
+}
+
+// monitor checks every interval until ctx is done. The session is closed when done.
+func (h *health) monitor(ctx context.Context, session *mgo.Session, client *elasticsearch.Client, ns string, interval time.Duration) {
+	defer session.Close()
+	// A check never takes longer than the interval.
+	session.SetSocketTimeout(interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.check(ctx, session, client, ns)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *health) check(ctx context.Context, session *mgo.Session, client *elasticsearch.Client, ns string) {
+	if err := client.Ping(ctx); err != nil {
+		h.logger.Warn("Elasticsearch health check failed", "err", err)
+	} else {
+		h.mu.Lock()
+		h.esOK = time.Now()
+		h.mu.Unlock()
+	}
+
+	acked := progress.Acked()
+	latest, err := mongodb.Optime(session)
+	var first mongodb.Timestamp
+	var ops int
+	if err == nil && acked != 0 {
+		first, ops, err = mongodb.PendingOperations(session, ns, acked, h.countLimit())
+	}
+	if err != nil {
+		h.logger.Warn("MongoDB health check failed", "namespace", ns, "err", err)
+		session.Refresh()
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mongoOK = time.Now()
+	// Nothing is known about the lag during an initial import.
+	if acked == 0 {
+		h.measured = false
+		return
+	}
+	h.measured = true
+	h.lagOps = ops
+	// The primary's optime moves with every namespace, the lag is how old the first operation still
+	// to catch up on is.
+	h.lag = 0
+	if ops > 0 {
+		if h.lag = latest.Time().Sub(*first.Time()); h.lag < 0 {
+			h.lag = 0
+		}
+	}
+}
+
+// healthy returns an error if MongoDB or elasticsearch has been unreachable for too long.
+func (h *health) healthy() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxUnreachable <= 0 {
+		return nil
+	}
+	if d := time.Since(h.mongoOK); d > h.maxUnreachable {
+		return fmt.Errorf("MongoDB unreachable for %s", d)
+	}
+	if d := time.Since(h.esOK); d > h.maxUnreachable {
+		return fmt.Errorf("Elasticsearch unreachable for %s", d)
+	}
+	return nil
+}
+
+// ready returns an error unless the river is healthy, done with any initial import and keeping up.
+func (h *health) ready() error {
+	if err := h.healthy(); err != nil {
+		return err
+	}
+	lag, ops, ok := h.Lag()
+	switch {
+	case !ok:
+		return errors.New("Replication lag is unknown, initial import may be running")
+	case h.maxLag > 0 && lag > h.maxLag:
+		return fmt.Errorf("Replication lag of %s is more than %s", lag, h.maxLag)
+	case h.maxLagOps > 0 && ops > h.maxLagOps:
+		return fmt.Errorf("Replication lag of %d operations is more than %d", ops, h.maxLagOps)
+	}
+	return nil
+}
+
+// healthHandler responds 200 if check returns nil, otherwise 503 with the error.
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
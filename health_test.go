@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReady(t *testing.T) {
+	h := newHealth(time.Minute, 100, time.Minute, slog.Default())
+	if err := h.healthy(); err != nil {
+		t.Error("Expected a new river to be healthy, got", err)
+	}
+	if err := h.ready(); err == nil {
+		t.Error("Expected not to be ready before the lag is measured")
+	}
+
+	tests := []struct {
+		lag   time.Duration
+		ops   int
+		ready bool
+	}{
+		{0, 0, true},
+		{30 * time.Second, 100, true},
+		{2 * time.Minute, 1, false},
+		{time.Second, 101, false},
+	}
+	for _, test := range tests {
+		h.mu.Lock()
+		h.measured, h.lag, h.lagOps = true, test.lag, test.ops
+		h.mu.Unlock()
+		if err := h.ready(); (err == nil) != test.ready {
+			t.Error(test.lag, test.ops, "expected ready to be", test.ready, "got", err)
+		}
+	}
+
+	if n := h.countLimit(); n != maxCountedOps {
+		t.Error("Expected operations to be counted up to", maxCountedOps, "got", n)
+	}
+	if n := newHealth(0, 2*maxCountedOps, 0, slog.Default()).countLimit(); n != 2*maxCountedOps+1 {
+		t.Error("Expected operations to be counted past max-lag-ops, got", n)
+	}
+
+	h.mu.Lock()
+	h.esOK = time.Now().Add(-2 * time.Minute)
+	h.mu.Unlock()
+	if h.healthy() == nil || h.ready() == nil {
+		t.Error("Expected elasticsearch being unreachable to be unhealthy")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, http.StatusOK},
+		{errors.New("MongoDB unreachable"), http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		healthHandler(func() error { return test.err })(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != test.code {
+			t.Error("Expected", test.code, "for", test.err, "got", w.Code)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// logLevel can be changed at runtime through logLevelHandler.
+var logLevel = new(slog.LevelVar)
+
+// newLogger returns a logger writing text, or json, to w at the given level. It's also made the
+// default, so that anything logged with the log package ends up in the same place.
+func newLogger(w io.Writer, json bool, level string) (*slog.Logger, error) {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("Invalid log level %q, use debug, info, warn or error", level)
+	}
+	options := &slog.HandlerOptions{AddSource: true, Level: logLevel}
+	var handler slog.Handler
+	if json {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// fatal logs the error and exits, like log.Fatal.
+func fatal(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logLevelHandler shows the log level, a POST with a level changes it.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if err := logLevel.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, "Invalid level, use debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logLevel.Level())
+}
@@ -2,10 +2,11 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"github.com/duego/cryriver/elasticsearch"
 	"github.com/duego/cryriver/mongodb"
+	"github.com/duego/cryriver/stats"
 	"labix.org/v2/mgo"
 	"log"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,13 +25,59 @@ var (
 	mongoServer   = flag.String("mongo", "localhost", "Specific server to tail")
 	mongoInitial  = flag.Bool("initial", false, "True if we want to force initial sync from the full collection, otherwise resume reading oplog if possible")
 	mongoTimeout  = flag.Int("timeout", 1, "Minutes to wait before timing out reading operations from MongoDB")
-	esServer      = flag.String("es", "http://localhost:9200", "Elasticsearch server to index to")
+	esServer      = flag.String("es", "http://localhost:9200", "Elasticsearch nodes to index to, separated by comma")
+	esSniff       = flag.Duration("sniff", 0, "How often to discover elasticsearch nodes from the cluster, 0 to only use the given nodes")
+	esTimeout     = flag.Duration("es-timeout", time.Minute, "How long a request to an elasticsearch node may take, 0 for no limit")
+	esUser        = flag.String("es-user", "", "Username for elasticsearch basic auth, defaults to $ES_USER")
+	esPassword    = flag.String("es-password", "", "Password for elasticsearch basic auth, defaults to $ES_PASSWORD")
+	esAPIKey      = flag.String("es-apikey", "", "Elasticsearch API key, either encoded or as id:key, defaults to $ES_APIKEY")
+	esToken       = flag.String("es-token", "", "Bearer token for elasticsearch, defaults to $ES_TOKEN")
+	esCA          = flag.String("es-ca", "", "PEM file with the certificate authorities to trust for elasticsearch")
+	esCert        = flag.String("es-cert", "", "PEM file with a client certificate for elasticsearch")
+	esKey         = flag.String("es-key", "", "PEM file with the key of the client certificate")
+	esInsecure    = flag.Bool("es-insecure", false, "Skip verifying elasticsearch certificates, only for testing")
+	esVersion     = flag.String("es-version", "", "Elasticsearch version to format bulk requests for, e.g. 1.7, 8.11 or opensearch-2.11, detected if empty")
+	esPipeline    = flag.String("pipeline", "", "Ingest pipeline to index documents through")
+	esAlias       = flag.Bool("require-alias", false, "Fail indexing unless the index is an alias, needs elasticsearch 7.10 or OpenSearch")
+	esRetries     = flag.Int("retry-on-conflict", 0, "How many times elasticsearch should retry updates on version conflicts")
+	esExternal    = flag.Bool("external-version", false, "Version indexed and deleted documents by their oplog timestamp so that older writes can't replace newer ones")
+	esCoalesce    = flag.Bool("coalesce", false, "Merge operations on the same document waiting to be sent in the same bulk request")
+	esBulkSize    = flag.Int("bulk-size", 1024, "Kilobytes to collect before sending a bulk request")
+	esBulkOps     = flag.Int("bulk-ops", 0, "Operations to collect before sending a bulk request, 0 for no limit")
+	esBulkAge     = flag.Duration("bulk-age", time.Second, "Longest time an operation waits before being sent, 0 to only send full bulk requests")
+	esMaxContent  = flag.Int("max-content-length", 100, "Megabytes elasticsearch accepts in one request, as set by http.max_content_length")
+	esGzip        = flag.Int("gzip", 0, "Gzip level for bulk requests from 1 (fastest) to 9 (smallest), -1 for the default level and 0 for no compression")
 	esConcurrency = flag.Int("concurrency", 1, "Maximum number of simultaneous ES connections")
+	esMinConc     = flag.Int("min-concurrency", 0, "Least number of simultaneous ES connections when adjusting them to the load, defaults to -concurrency")
+	esMaxConc     = flag.Int("max-concurrency", 0, "Most number of simultaneous ES connections when adjusting them to the load, defaults to -concurrency")
+	esPartitions  = flag.Int("partitions", 0, "Partition operations by _id over this many slurpers, keeping every document in oplog order. Replaces -concurrency when set")
 	esIndex       = flag.String("index", "testing", "Elasticsearch index to use")
 	optimeStore   = flag.String("db", "/tmp/cryriver.db", "What file to save progress on for oplog resumes")
 	ns            = flag.String("ns", "api.users", "The namespace to tail on")
 	debugAddr     = flag.String("debug", "127.0.0.1:5000", "Which address to listen on for debug, empty for no debug")
+	adminToken    = flag.String("admin-token", "", "Bearer token required by /admin endpoints on the debug address, defaults to $CRYRIVER_ADMIN_TOKEN")
 	numCpu        = flag.Int("cpu", 0, "Maximum number of parallell tasks to do, defaults to number of available CPUs")
+	maxLag        = flag.Duration("max-lag", 5*time.Minute, "Replication lag after which /readyz reports not ready, 0 to not check")
+	maxLagOps     = flag.Int("max-lag-ops", 0, "Operations behind after which /readyz reports not ready, 0 to not check")
+	shutdownWait  = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for operations already read to be sent when stopping")
+	maxUnreach    = flag.Duration("max-unreachable", 5*time.Minute, "How long MongoDB or elasticsearch may be unreachable before /healthz reports unhealthy, 0 to not check")
+	logLevelFlag  = flag.String("log-level", "info", "Log level: debug, info, warn or error, can be changed at runtime on /admin/loglevel")
+	logJSON       = flag.Bool("log-json", false, "Log json instead of text")
+	traceTarget   = flag.String("trace", "", "OTLP/HTTP endpoint to send traces to, e.g. http://localhost:4318, or stdout. Empty for no tracing")
+	traceRatio    = flag.Float64("trace-ratio", 1, "Ratio of operations to trace, from 0 to 1")
+	configFile    = flag.String("config", "", "Json file with settings for each namespace")
+	softDelete    = flag.Bool("softdelete", true, "Delete documents flagged with deleted: true unless another rule is configured for the namespace")
+)
+
+const (
+	// Operations queued for an adjustable slurper pool.
+	queueSize = 1000
+	// How often the slurper pool is adjusted.
+	poolInterval = 10 * time.Second
+	// How often replication lag and connectivity is checked.
+	healthInterval = 10 * time.Second
+	// How long to wait for the last traces to be exported when stopping.
+	tracingTimeout = 5 * time.Second
 )
 
 func main() {
@@ -39,48 +87,199 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
 	flag.Parse()
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	logger, err := newLogger(os.Stderr, *logJSON, *logLevelFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopTracing, err := startTracing(*traceTarget, *traceRatio)
+	if err != nil {
+		fatal(logger, "Could not start tracing", "trace", *traceTarget, "err", err)
+	}
+
+	if !*softDelete {
+		mongodb.DefaultDeleteRule = nil
+	}
+	// Cancelling ctx stops reading the oplog, operations already read are still sent until sendCtx is
+	// cancelled.
+	ctx, stopReading := context.WithCancel(context.Background())
+	sendCtx, abortSending := context.WithCancel(context.Background())
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fatal(logger, "Invalid config", "file", *configFile, "err", err)
+	}
+	// A script stuck on an operation is cancelled along with sending, see -shutdown-timeout.
+	if err := config.apply(sendCtx); err != nil {
+		fatal(logger, "Invalid config", "file", *configFile, "err", err)
+	}
 
 	// Enable http server for debug endpoint
+	http.Handle("/metrics", stats.Handler())
+	token := flagOrEnv(*adminToken, "CRYRIVER_ADMIN_TOKEN")
+	http.Handle("/admin/loglevel", requireToken(token, http.HandlerFunc(logLevelHandler)))
 	go func() {
 		if *debugAddr != "" {
-			log.Println(http.ListenAndServe(*debugAddr, nil))
+			logger.Error("Debug server stopped", "err", http.ListenAndServe(*debugAddr, nil))
 		}
 	}()
 
-	interrupt := make(chan os.Signal)
+	credentials := &elasticsearch.Credentials{
+		Username:    flagOrEnv(*esUser, "ES_USER"),
+		Password:    flagOrEnv(*esPassword, "ES_PASSWORD"),
+		APIKey:      flagOrEnv(*esAPIKey, "ES_APIKEY"),
+		BearerToken: flagOrEnv(*esToken, "ES_TOKEN"),
+	}
+	tlsConfig, err := elasticsearch.TLSConfig(*esCA, *esCert, *esKey, *esInsecure)
+	if err != nil {
+		fatal(logger, "Invalid TLS settings", "err", err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
+	// Without partitions the number of slurpers is adjusted to the load between these bounds.
+	minSlurpers, maxSlurpers := *esConcurrency, *esConcurrency
+	if *esMinConc > 0 {
+		minSlurpers = *esMinConc
+	}
+	if *esMaxConc > 0 {
+		maxSlurpers = *esMaxConc
+	}
+	if maxSlurpers < minSlurpers {
+		maxSlurpers = minSlurpers
+	}
+
+	// The client will have the transport configured to allow the same amount of connections
+	// as go routines towards ES, each connection may be re-used between slurpers.
+	maxConn := maxSlurpers
+	if *esPartitions > maxConn {
+		maxConn = *esPartitions
+	}
+	client := elasticsearch.NewClient(strings.Split(*esServer, ","), maxConn)
+	client.Credentials = credentials
+	client.Logger = logger
+	client.Timeout = *esTimeout
+	client.UseTLS(tlsConfig)
+	if err := client.SetGzip(*esGzip); err != nil {
+		fatal(logger, "Invalid gzip level", "err", err)
+	}
+	if *esSniff > 0 {
+		if err := client.Sniff(ctx); err != nil {
+			logger.Warn("Sniffing elasticsearch nodes failed", "err", err)
+		}
+		go client.SniffEvery(ctx, *esSniff)
+	}
+	bulkOptions := elasticsearch.BulkOptions{
+		Pipeline:         *esPipeline,
+		RequireAlias:     *esAlias,
+		RetryOnConflict:  *esRetries,
+		ExternalVersion:  *esExternal,
+		Coalesce:         *esCoalesce,
+		MaxContentLength: elasticsearch.ByteSize(*esMaxContent) * elasticsearch.MB,
+	}
+	if *esVersion != "" {
+		bulkOptions.Version, err = elasticsearch.ParseVersion(*esVersion)
+	} else {
+		bulkOptions.Version, err = client.DetectVersion(ctx)
+	}
+	if err != nil {
+		fatal(logger, "Could not tell the elasticsearch version, try setting -es-version", "err", err)
+	}
+	logger.Info("Formatting bulk requests for elasticsearch", "version", bulkOptions.Version)
+	flushLimits := elasticsearch.FlushLimits{
+		MaxBytes: elasticsearch.ByteSize(*esBulkSize) * elasticsearch.KB,
+		MaxOps:   *esBulkOps,
+		MaxAge:   *esBulkAge,
+	}
+
 	mgoSession, err := mgo.DialWithTimeout(*mongoServer+"?connect=direct", time.Duration(*mongoTimeout)*time.Minute)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, "Could not connect to MongoDB", "server", *mongoServer, "err", err)
 	}
 	defer mgoSession.Close()
+	checkpointCtx, cancelCheckpointer := context.WithCancel(context.Background())
+	lastTs := startCheckpointer(checkpointCtx, logger)
+	health := newHealth(*maxLag, *maxLagOps, *maxUnreach, logger)
+	http.Handle("/healthz", healthHandler(health.healthy))
+	http.Handle("/readyz", healthHandler(health.ready))
+	go health.monitor(ctx, mgoSession.Copy(), client, *ns, healthInterval)
 	mongoc := make(chan *mongodb.Operation)
 	mongoErr := make(chan error)
-	exit := make(chan bool)
+	pause := newPauser()
+	oplog := newTailer(mgoSession, *ns, pause, logger)
 	go func() {
-		mongoErr <- mongodb.Tail(mgoSession, *ns, *mongoInitial, lastEsSeen, mongoc, exit)
+		mongoErr <- oplog.run(ctx, *mongoInitial, lastTs, mongoc)
 	}()
 
-	esc := make(chan elasticsearch.Transaction)
+	// Without partitions all slurpers share one channel, otherwise each slurper gets its own.
+	var escs []chan elasticsearch.Transaction
+	var pool *elasticsearch.Pool
+	var throttle *elasticsearch.Throttle
+	// Makes all slurpers send what they have collected when asked to on /admin/flush.
+	flusher := elasticsearch.NewFlusher()
 	esDone := make(chan bool)
-	go func() {
-		// Boot up our slurpers.
-		// The client will have the transport configured to allow the same amount of connections
-		// as go routines towards ES, each connection may be re-used between slurpers.
-		client := elasticsearch.NewClient(fmt.Sprintf("%s/_bulk", *esServer), *esConcurrency)
+	if *esPartitions > 0 {
+		// Shared by all slurpers to back off together when elasticsearch is too busy.
+		throttle = elasticsearch.NewThrottle(*esPartitions, flushLimits.MaxBytes)
 		var slurpers sync.WaitGroup
-		slurpers.Add(*esConcurrency)
-		for n := 0; n < *esConcurrency; n++ {
+		slurpers.Add(*esPartitions)
+		for n := 0; n < *esPartitions; n++ {
+			esc := make(chan elasticsearch.Transaction)
+			escs = append(escs, esc)
 			go func() {
-				elasticsearch.Slurp(client, esc)
+				elasticsearch.Slurp(sendCtx, client, esc, bulkOptions, flushLimits, throttle, flusher, logger)
 				slurpers.Done()
 			}()
 		}
-		slurpers.Wait()
-		close(esDone)
-	}()
+		go func() {
+			slurpers.Wait()
+			close(esDone)
+		}()
+	} else {
+		throttle = elasticsearch.NewThrottle(maxSlurpers, flushLimits.MaxBytes)
+		// The pool grows while operations queue up in the channel.
+		var esc chan elasticsearch.Transaction
+		if minSlurpers < maxSlurpers {
+			esc = make(chan elasticsearch.Transaction, queueSize)
+		} else {
+			esc = make(chan elasticsearch.Transaction)
+		}
+		escs = append(escs, esc)
+		pool = elasticsearch.NewPool(sendCtx, client, esc, bulkOptions, flushLimits, throttle, flusher, logger, minSlurpers, maxSlurpers)
+		pool.Resize(*esConcurrency)
+		if minSlurpers < maxSlurpers {
+			go pool.Adjust(ctx, poolInterval)
+		}
+		http.Handle("/admin/pool", requireToken(token, poolHandler(pool)))
+		go func() {
+			pool.Wait()
+			close(esDone)
+		}()
+	}
+
+	queues := func() map[string]int {
+		n := map[string]int{"mongoc": len(mongoc)}
+		for _, esc := range escs {
+			n["esc"] += len(esc)
+		}
+		return n
+	}
+	stats.QueueDepth.Func(func() float64 { return float64(queues()["mongoc"]) }, "mongoc")
+	stats.QueueDepth.Func(func() float64 { return float64(queues()["esc"]) }, "esc")
+
+	rewinds := make(chan rewind)
+	api := &admin{
+		ns:      *ns,
+		pause:   pause,
+		rewinds: rewinds,
+		stopped: ctx.Done(),
+		flusher: flusher,
+		client:  client,
+		health:  health,
+		queues:  queues,
+	}
+	api.register(http.DefaultServeMux, token)
 
 	tailDone := make(chan bool)
 	go func() {
@@ -88,16 +287,64 @@ func main() {
 		indexes := map[string]string{
 			strings.Split(*ns, ".")[0]: *esIndex,
 		}
-		for op := range mongoc {
-			// Wrap all mongo operations to comply with ES interface, then send them off to the slurper.
-			esOp := mongodb.NewEsOperation(indexes, nil, op)
+	tail:
+		for {
+			var op *mongodb.Operation
+			var ok bool
 			select {
-			case esc <- esOp:
-				lastEsSeenC <- &op.Timestamp
-			// Abort delivering any pending EsOperations we might block for
-			case <-exit:
-				break
+			case op, ok = <-mongoc:
+				if !ok {
+					break tail
+				}
+			case r := <-rewinds:
+				r.done <- r.apply(ctx, oplog)
+				continue
+			}
+			if op.Op == mongodb.ImportDone {
+				// Progress is saved from when the import started, once everything imported is acknowledged.
+				progress.add(op.Timestamp, 0)
+				op.Done(nil)
+				continue
+			}
+			// Wrap all mongo operations to comply with ES interface, then send them off to the slurper.
+			esOps, err := mongodb.NewEsOperations(indexes, nil, op)
+			if err != nil {
+				id, _ := op.ObjectId()
+				logger.Error("Could not convert operation", "namespace", op.Namespace, "ts", op.Timestamp, "_id", id.Hex(), "err", err)
+			}
+			// Progress isn't saved during the initial import, an interrupted import has to start over.
+			checkpoint := op.Timestamp
+			if op.Initial {
+				checkpoint = 0
 			}
+			pending := progress.add(checkpoint, len(esOps))
+			for _, esOp := range esOps {
+				// Stop reading the oplog while elasticsearch is rejecting requests.
+				if throttle.Wait(sendCtx) != nil {
+					op.Done(nil)
+					break tail
+				}
+				// Operations on the same document always go to the same partition to keep them in order.
+				esc := escs[0]
+				if len(escs) > 1 {
+					partition, err := elasticsearch.Partition(esOp, len(escs))
+					if err != nil {
+						logger.Error("Could not partition operation", "namespace", op.Namespace, "ts", op.Timestamp, "err", err)
+						pending.Acknowledge(err)
+						continue
+					}
+					esc = escs[partition]
+				}
+				select {
+				case esc <- acked{esOp, pending}:
+				// Abort delivering any pending EsOperations we might block for
+				case <-sendCtx.Done():
+					op.Done(nil)
+					break tail
+				}
+			}
+			op.Done(err)
+			atomic.StoreInt64(&lastDispatched, int64(op.Timestamp))
 		}
 		// If mongoc closed, tailer has stopped
 		close(tailDone)
@@ -106,30 +353,85 @@ func main() {
 	select {
 	//  Get more operations from mongo tail
 	case <-tailDone:
-		log.Println("MongoDB tailer returned")
+		logger.Info("MongoDB tailer returned")
 	// ES client closed
 	case <-esDone:
-		log.Println("ES slurper returned")
+		logger.Info("ES slurper returned")
 	// An interrupt signal was catched
 	case <-interrupt:
-		log.Println("Closing down...")
+		logger.Info("Closing down...")
 	}
-	close(exit)
+	stopReading()
+	// Failures before now were logged when they happened, only the operations still being sent decide
+	// how we exit.
+	progress.forgetFailures()
+	clean := true
 
 	// MongoDB tailer shutdown
 	if err := <-mongoErr; err != nil {
-		log.Println(err)
+		logger.Error("MongoDB tail failed", "err", err)
+		clean = false
 	} else {
-		log.Println("No errors occured in mongo tail")
+		logger.Info("No errors occured in mongo tail")
+	}
+
+	// Operations already read are sent before stopping, unless it takes too long or we are
+	// interrupted again.
+	drained := make(chan bool)
+	go func() {
+		logger.Info("Waiting for EsOperation tail to stop")
+		<-tailDone
+		logger.Info("Waiting for ES to return")
+		// We are the producer for these channels, close them down and wait for ES slurpers to return
+		if pool != nil {
+			pool.Close()
+		} else {
+			for _, esc := range escs {
+				close(esc)
+			}
+		}
+		<-esDone
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		logger.Info("All operations read have been sent")
+	case <-time.After(*shutdownWait):
+		logger.Error("Timed out sending the operations read", "timeout", *shutdownWait)
+		clean = false
+	case <-interrupt:
+		logger.Error("Interrupted while sending the operations read")
+		clean = false
+	}
+	abortSending()
+	if !progress.Done() {
+		logger.Error("Elasticsearch did not write every operation read")
+		clean = false
 	}
 
-	// Elasticsearch indexer shutdown
-	log.Println("Waiting for EsOperation tail to stop")
-	<-tailDone
+	// Only what elasticsearch acknowledged is saved, anything after it is read again on restart.
+	if ts, err := stopCheckpointer(cancelCheckpointer); err != nil {
+		logger.Error("Could not save the final checkpoint", "err", err)
+		clean = false
+	} else {
+		logger.Info("Saved the final checkpoint", "ts", ts)
+	}
+	tracingCtx, cancel := context.WithTimeout(context.Background(), tracingTimeout)
+	defer cancel()
+	if err := stopTracing(tracingCtx); err != nil {
+		logger.Error("Could not export traces", "err", err)
+	}
+	if !clean {
+		fatal(logger, "Stopped without sending everything")
+	}
+	logger.Info("Bye!")
+}
 
-	log.Println("Waiting for ES to return")
-	// We are the producer for this channel, close it down and wait for ES slurpers to return
-	close(esc)
-	<-esDone
-	log.Println("Bye!")
+// flagOrEnv returns the flag value, or the environment variable if the flag is empty. Used for
+// secrets that shouldn't be visible in the process list.
+func flagOrEnv(value, env string) string {
+	if value == "" {
+		return os.Getenv(env)
+	}
+	return value
 }
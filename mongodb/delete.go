@@ -0,0 +1,101 @@
+package mongodb
+
+import (
+	"labix.org/v2/mgo/bson"
+	"reflect"
+)
+
+// DeletePredicate decides how the field of a DeleteRule is matched.
+type DeletePredicate string
+
+const (
+	// Equals matches when the field has the same value as the rule.
+	Equals DeletePredicate = "equals"
+	// Exists matches when the field is present, even if it is null.
+	Exists DeletePredicate = "exists"
+	// NotNull matches when the field is present and not null.
+	NotNull DeletePredicate = "notnull"
+)
+
+// DeleteRule turns inserts and updates into deletes for collections that soft delete their documents
+// by flagging them rather than removing them.
+type DeleteRule struct {
+	// Field is the path to look at, nested documents are separated by dots. An empty field disables
+	// the rule.
+	Field string `json:"field"`
+
+	// When is the predicate used for matching, defaults to Equals.
+	When DeletePredicate `json:"when"`
+
+	// Value is what the field should equal when using Equals.
+	Value interface{} `json:"value"`
+}
+
+// Match reports whether the document should be deleted rather than indexed.
+// Fields listed in unsets are treated as missing as they are being removed from the document.
+func (r *DeleteRule) Match(doc bson.M, unsets bson.M) bool {
+	if r == nil || r.Field == "" {
+		return false
+	}
+	if _, ok := lookupPath(unsets, r.Field); ok {
+		return false
+	}
+	v, ok := lookupPath(doc, r.Field)
+	if !ok {
+		return false
+	}
+
+	switch r.When {
+	case Exists:
+		return true
+	case NotNull:
+		return v != nil
+	case Equals, "":
+		return equalValues(v, r.Value)
+	}
+	return false
+}
+
+// equalValues compares two values, numbers are compared by value regardless of type as rules are
+// usually read from json where every number is a float64.
+func equalValues(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// DefaultDeleteRule is used for namespaces not found in DeleteRules. Set it to nil to only delete
+// documents when they are removed from MongoDB.
+var DefaultDeleteRule = &DeleteRule{Field: "deleted", When: Equals, Value: true}
+
+// DeleteRules maps namespaces to the rule used for soft deletes, a nil rule disables soft deletes for
+// the namespace.
+var DeleteRules = make(map[string]*DeleteRule)
+
+// deleteRule returns the rule in effect for the namespace.
+func deleteRule(ns string) *DeleteRule {
+	if rule, ok := DeleteRules[ns]; ok {
+		return rule
+	}
+	return DefaultDeleteRule
+}
@@ -0,0 +1,78 @@
+package mongodb
+
+import (
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+func TestDeleteRuleMatch(t *testing.T) {
+	doc := bson.M{
+		"deleted":    true,
+		"archivedAt": nil,
+		"status":     "removed",
+		"count":      3,
+		"meta": bson.M{
+			"state": "gone",
+		},
+		"flags.hidden": true,
+	}
+	tests := []struct {
+		rule  DeleteRule
+		match bool
+	}{
+		{DeleteRule{Field: "deleted", Value: true}, true},
+		{DeleteRule{Field: "deleted", When: Equals, Value: false}, false},
+		{DeleteRule{Field: "status", When: Equals, Value: "removed"}, true},
+		{DeleteRule{Field: "count", When: Equals, Value: float64(3)}, true},
+		{DeleteRule{Field: "archivedAt", When: Exists}, true},
+		{DeleteRule{Field: "archivedAt", When: NotNull}, false},
+		{DeleteRule{Field: "missing", When: Exists}, false},
+		{DeleteRule{Field: "meta.state", When: Equals, Value: "gone"}, true},
+		{DeleteRule{Field: "flags.hidden", When: NotNull}, true},
+		{DeleteRule{Field: "", When: Exists}, false},
+	}
+	for _, test := range tests {
+		if m := test.rule.Match(doc, nil); m != test.match {
+			t.Errorf("Expected %+v to return %v, got %v", test.rule, test.match, m)
+		}
+	}
+}
+
+func TestDeleteRuleUnset(t *testing.T) {
+	rule := DeleteRule{Field: "archivedAt", When: Exists}
+	doc := bson.M{"archivedAt": nil}
+	if rule.Match(doc, bson.M{"archivedAt": 1}) {
+		t.Error("Expected unset fields to not match")
+	}
+}
+
+func TestDeleteRuleNamespace(t *testing.T) {
+	defer func() { DeleteRules = make(map[string]*DeleteRule) }()
+
+	indexes := map[string]string{"test": "test"}
+	newOp := func(ns string, object bson.M) *EsOperation {
+		return NewEsOperation(indexes, nil, bsonToOperation(t, &bson.M{
+			"op": "i",
+			"ns": ns,
+			"o":  object,
+		}))
+	}
+	id := bson.ObjectIdHex("52e7e160f4eb2740dda12844")
+
+	if a, _ := newOp("test.users", bson.M{"_id": id, "deleted": true}).Action(); a != "delete" {
+		t.Error("Expected default rule to delete, got", a)
+	}
+
+	DeleteRules["test.users"] = nil
+	if a, _ := newOp("test.users", bson.M{"_id": id, "deleted": true}).Action(); a != "index" {
+		t.Error("Expected disabled rule to index, got", a)
+	}
+
+	DeleteRules["test.items"] = &DeleteRule{Field: "status", When: Equals, Value: "removed"}
+	if a, _ := newOp("test.items", bson.M{"_id": id, "status": "removed"}).Action(); a != "delete" {
+		t.Error("Expected custom rule to delete, got", a)
+	}
+	if a, _ := newOp("test.items", bson.M{"_id": id, "deleted": true}).Action(); a != "index" {
+		t.Error("Expected custom rule to replace the default, got", a)
+	}
+}
@@ -1,10 +1,13 @@
 package mongodb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/duego/cryriver/stats"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"labix.org/v2/mgo/bson"
 	"strings"
 	"time"
@@ -18,8 +21,27 @@ const (
 	Insert  OplogOperation = "i"
 	Delete  OplogOperation = "d"
 	Command OplogOperation = "c"
+
+	// ImportDone is not in the oplog. Tail sends it once an initial import has read every document,
+	// with the optime the import started at.
+	ImportDone OplogOperation = "import done"
 )
 
+// Name returns the operation spelled out, as used in metrics.
+func (o OplogOperation) Name() string {
+	switch o {
+	case Update:
+		return "update"
+	case Insert:
+		return "insert"
+	case Delete:
+		return "delete"
+	case Command:
+		return "command"
+	}
+	return string(o)
+}
+
 // OperationError formats errors to have a pretty printed json object to accompany the message.
 type OperationError struct {
 	// The error message
@@ -44,11 +66,20 @@ type Operation struct {
 
 	// The target document on update queires, should contain an id.
 	UpdateObject bson.M `bson:"o2"`
+
+	// Initial is true for documents read by the initial import, which carry the optime of when the
+	// import started as their Timestamp.
+	Initial bool `bson:"-"`
+
+	// Carries the span of the operation, see Context.
+	ctx context.Context
 }
 
 func (op Operation) String() string {
 	if b, err := json.MarshalIndent(op, "", "\t"); err != nil {
-		return fmt.Sprint(op)
+		// Formatted without this method, which would call itself.
+		type plain Operation
+		return fmt.Sprintf("%+v", plain(op))
 	} else {
 		return string(b)
 	}
@@ -84,9 +115,22 @@ type EsOperation struct {
 	namespaceSplit *[2]string
 	doc            map[string]interface{}
 	action         string
+
+	// Set when a manipulator has rerouted the operation to another index.
+	index string
+
+	// Set when a manipulator has asked for the operation to not be sent.
+	skip bool
 }
 
+// NewEsOperation prepares the operation to be sent to ES. An error preparing the document is
+// returned again by Document.
 func NewEsOperation(indexes map[string]string, manips []Manipulator, op *Operation) *EsOperation {
+	esOp, _ := newEsOperation(indexes, manips, op)
+	return esOp
+}
+
+func newEsOperation(indexes map[string]string, manips []Manipulator, op *Operation) (*EsOperation, error) {
 	if manips == nil {
 		manips = DefaultManipulators
 	}
@@ -96,21 +140,60 @@ func NewEsOperation(indexes map[string]string, manips []Manipulator, op *Operati
 		indexMap:     indexes,
 	}
 
-	// Return delete operation if object delete == true.
-	doc, err := esOp.Document()
-	if err == nil {
-		if v, ok := doc["deleted"]; ok {
-			if deleted, ok := v.(bool); deleted && ok {
-				esOp = EsOperation{
-					Operation: op,
-					action:    "delete",
-					doc:       make(map[string]interface{}),
-					indexMap:  indexes,
-				}
+	// Prepare the document, this will also turn the operation into a delete if the document matches
+	// the soft delete rule of the namespace.
+	_, err := esOp.Document()
+	return &esOp, err
+}
+
+// NewEsOperations returns the operations to send to ES for one oplog entry. The operation is first
+// prepared like NewEsOperation and then passed through OperationManipulators, which may drop it or
+// turn it into several operations.
+func NewEsOperations(indexes map[string]string, manips []Manipulator, op *Operation) (ops []*EsOperation, err error) {
+	_, span := tracer.Start(op.Context(), "transform")
+	defer func() {
+		span.SetAttributes(attribute.Int("operations", len(ops)))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	esOp, err := newEsOperation(indexes, manips, op)
+	if err != nil {
+		return nil, err
+	}
+	if esOp.skip {
+		return nil, nil
+	}
+	ops = []*EsOperation{esOp}
+	for _, opManip := range OperationManipulators {
+		next := make([]*EsOperation, 0, len(ops))
+		for _, esOp := range ops {
+			result, err := opManip.ManipulateOperation(esOp)
+			if err != nil {
+				return nil, err
 			}
+			next = append(next, result...)
 		}
+		ops = next
 	}
-	return &esOp
+	return ops, nil
+}
+
+// WithIndex returns a copy of the operation sent to another index.
+func (op *EsOperation) WithIndex(index string) *EsOperation {
+	c := *op
+	c.index = index
+	return &c
+}
+
+// WithDocument returns a copy of the operation with the document replaced.
+func (op *EsOperation) WithDocument(doc map[string]interface{}) *EsOperation {
+	c := *op
+	c.doc = doc
+	return &c
 }
 
 // Id returns the object id as a hex string for the current Operation.
@@ -139,12 +222,12 @@ func (op *EsOperation) Action() (string, error) {
 	return op.action, nil
 }
 
-// Document returns the changed document for Insert or Update.
+// Document returns the changed document for Insert or Update, and an empty one for Delete. The
+// document is only kept once it has been prepared without errors.
 func (op *EsOperation) Document() (map[string]interface{}, error) {
 	if op.doc != nil {
 		return op.doc, nil
 	}
-	op.doc = make(map[string]interface{})
 
 	var changes bson.M
 
@@ -175,16 +258,42 @@ func (op *EsOperation) Document() (map[string]interface{}, error) {
 	case Insert:
 		stats.Complete.Add(1)
 		changes = bson.M(op.Object)
+	case Delete:
+		// Only the id is sent, there is nothing to manipulate.
+		op.doc = make(map[string]interface{})
+		return op.doc, nil
 	default:
 		return nil, OperationError{"Unsupported operation", op}
 	}
 
 	// Run the document through the manipulators to make it look like we want it to before it hits ES
-	for _, manip := range op.manipulators {
-		if err := manip.Manipulate(&changes, op.Op); err != nil {
-			return nil, err
+	for _, manips := range [][]Manipulator{op.manipulators, NamespaceManipulators[op.Namespace]} {
+		for _, manip := range manips {
+			switch err := manip.Manipulate(&changes, op.Op); e := err.(type) {
+			case nil:
+			case Reroute:
+				op.index = e.Index
+			default:
+				if err == SkipOperation {
+					// An empty document is never sent to ES.
+					op.skip = true
+					op.doc = make(map[string]interface{})
+					return op.doc, nil
+				}
+				return nil, err
+			}
 		}
 	}
+
+	// Soft deletes are checked before the projection as the flag might not be sent to ES.
+	unsets, _ := op.Object["$unset"].(bson.M)
+	if deleteRule(op.Namespace).Match(changes, unsets) {
+		op.action = "delete"
+		op.doc = make(map[string]interface{})
+		return op.doc, nil
+	}
+	changes = Projections[op.Namespace].Apply(changes)
+
 	// Stored as a map so that ES doesn't have to know about bson.M which is the same.
 	op.doc = map[string]interface{}(changes)
 
@@ -204,6 +313,9 @@ func (op *EsOperation) nsSplit() (string, string, error) {
 }
 
 func (op *EsOperation) Index() (string, error) {
+	if op.index != "" {
+		return op.index, nil
+	}
 	i, _, e := op.nsSplit()
 	if e != nil {
 		return i, e
@@ -219,6 +331,32 @@ func (op *EsOperation) Type() (string, error) {
 	return t, e
 }
 
+// Version returns the oplog timestamp, which grows with every change and can be used as an external
+// version in ES.
+func (op *EsOperation) Version() (int64, error) {
+	return int64(op.Timestamp), nil
+}
+
+// Routing returns the value of the routing field configured for the namespace in Routings. The
+// field is looked for in the document, then in the target of updates (which holds the shard key in
+// sharded clusters) and finally in the object of deletes. No routing is used if it can't be found.
+func (op *EsOperation) Routing() (string, error) {
+	field, ok := Routings[op.Namespace]
+	if !ok {
+		return "", nil
+	}
+	doc, _ := op.Document()
+	for _, object := range []bson.M{bson.M(doc), op.UpdateObject, op.Object} {
+		if v, ok := lookupPath(object, field); ok && v != nil {
+			if id, ok := v.(bson.ObjectId); ok {
+				return id.Hex(), nil
+			}
+			return fmt.Sprint(v), nil
+		}
+	}
+	return "", nil
+}
+
 func (op *EsOperation) Time() *time.Time {
 	return op.Timestamp.Time()
 }
@@ -237,3 +375,37 @@ func (m ManipulateFunc) Manipulate(doc *bson.M, op OplogOperation) error {
 }
 
 var DefaultManipulators = make([]Manipulator, 0, 100)
+
+// Routings maps namespaces to the field used for routing documents to ES shards.
+var Routings = make(map[string]string)
+
+// OperationManipulator decides which operations are sent to ES in place of one prepared operation.
+// Unlike a Manipulator it sees the whole operation, including namespace, timestamp and _id, and may
+// return any number of operations. Returning none drops the operation.
+type OperationManipulator interface {
+	ManipulateOperation(op *EsOperation) ([]*EsOperation, error)
+}
+
+// ManipulateOperationFunc makes a function into an OperationManipulator
+type ManipulateOperationFunc func(op *EsOperation) ([]*EsOperation, error)
+
+func (m ManipulateOperationFunc) ManipulateOperation(op *EsOperation) ([]*EsOperation, error) {
+	return m(op)
+}
+
+// OperationManipulators are run by NewEsOperations in order, each one on every operation returned by
+// the previous.
+var OperationManipulators = make([]OperationManipulator, 0, 100)
+
+// SkipOperation can be returned by a Manipulator to not send the operation to ES.
+var SkipOperation = errors.New("Operation skipped")
+
+// Reroute can be returned by a Manipulator to send the operation to another index than the one
+// mapped for its database. The document changes are kept and the following manipulators still run.
+type Reroute struct {
+	Index string
+}
+
+func (r Reroute) Error() string {
+	return "Operation rerouted to index " + r.Index
+}
@@ -1,6 +1,9 @@
 package mongodb
 
 import (
+	"errors"
+	"github.com/duego/cryriver/elasticsearch"
+	"io/ioutil"
 	"labix.org/v2/mgo/bson"
 	"testing"
 	"time"
@@ -225,3 +228,161 @@ func TestInsertOperation(t *testing.T) {
 		}
 	}
 }
+
+func TestEsOperationSkipReroute(t *testing.T) {
+	op := bsonToOperation(t, &bson.M{
+		"op": "i",
+		"ns": "test.users",
+		"o": map[string]interface{}{
+			"_id":   bson.ObjectIdHex("50eadae392cd864e50cd0dbc"),
+			"alias": "Johnny",
+		},
+	})
+	indexes := map[string]string{"test": "test"}
+
+	reroute := ManipulateFunc(func(doc *bson.M, op OplogOperation) error {
+		return Reroute{Index: "users_search"}
+	})
+	esOp := NewEsOperation(indexes, []Manipulator{reroute}, op)
+	if i, _ := esOp.Index(); i != "users_search" {
+		t.Error("Expected rerouted index, got", i)
+	}
+	if d, _ := esOp.Document(); len(d) != 2 {
+		t.Error("Expected document to be kept:", d)
+	}
+
+	skip := ManipulateFunc(func(doc *bson.M, op OplogOperation) error {
+		return SkipOperation
+	})
+	esOp = NewEsOperation(indexes, []Manipulator{skip}, op)
+	if d, err := esOp.Document(); err != nil || len(d) != 0 {
+		t.Error("Expected an empty document when skipped:", d, err)
+	}
+}
+
+func TestNewEsOperations(t *testing.T) {
+	defer func() { OperationManipulators = make([]OperationManipulator, 0, 100) }()
+
+	op := bsonToOperation(t, &bson.M{
+		"op": "i",
+		"ns": "test.users",
+		"o": map[string]interface{}{
+			"_id":   bson.ObjectIdHex("50eadae392cd864e50cd0dbc"),
+			"alias": "Johnny",
+		},
+	})
+	indexes := map[string]string{"test": "test"}
+
+	OperationManipulators = append(OperationManipulators, ManipulateOperationFunc(func(op *EsOperation) ([]*EsOperation, error) {
+		if op.Namespace != "test.users" {
+			return nil, nil
+		}
+		return []*EsOperation{op, op.WithIndex("users_search")}, nil
+	}))
+	esOps, err := NewEsOperations(indexes, nil, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(esOps) != 2 {
+		t.Fatal("Expected two operations, got", len(esOps))
+	}
+	for n, index := range []string{"test", "users_search"} {
+		if i, _ := esOps[n].Index(); i != index {
+			t.Error("Expected index", index, "got", i)
+		}
+		if d, _ := esOps[n].Document(); d["alias"] != "Johnny" {
+			t.Error("Expected document to be kept:", d)
+		}
+	}
+
+	op.Namespace = "test.photos"
+	if esOps, err := NewEsOperations(indexes, nil, op); err != nil || len(esOps) != 0 {
+		t.Error("Expected operation to be dropped:", esOps, err)
+	}
+
+	skip := ManipulateFunc(func(doc *bson.M, op OplogOperation) error {
+		return SkipOperation
+	})
+	op.Namespace = "test.users"
+	if esOps, err := NewEsOperations(indexes, []Manipulator{skip}, op); err != nil || len(esOps) != 0 {
+		t.Error("Expected skipped operation to be dropped:", esOps, err)
+	}
+}
+
+func TestNewEsOperationsError(t *testing.T) {
+	op := bsonToOperation(t, &bson.M{
+		"op": "i",
+		"ns": "test.users",
+		"o": map[string]interface{}{
+			"_id":   bson.ObjectIdHex("50eadae392cd864e50cd0dbc"),
+			"alias": "Johnny",
+		},
+	})
+	indexes := map[string]string{"test": "test"}
+
+	fail := ManipulateFunc(func(doc *bson.M, op OplogOperation) error {
+		return errors.New("Broken")
+	})
+	if esOps, err := NewEsOperations(indexes, []Manipulator{fail}, op); err == nil || len(esOps) != 0 {
+		t.Error("Expected the error of the manipulator:", esOps, err)
+	}
+	esOp := NewEsOperation(indexes, []Manipulator{fail}, op)
+	for i := 0; i < 2; i++ {
+		if d, err := esOp.Document(); err == nil || d != nil {
+			t.Error("Expected the error again from Document:", d, err)
+		}
+	}
+}
+
+func TestNewEsOperationsDelete(t *testing.T) {
+	op := bsonToOperation(t, &bson.M{
+		"op": "d",
+		"ns": "test.users",
+		"o": map[string]interface{}{
+			"_id": bson.ObjectIdHex("50eadae392cd864e50cd0dbc"),
+		},
+	})
+	indexes := map[string]string{"test": "test"}
+
+	// Manipulators are not run for deletes.
+	fail := ManipulateFunc(func(doc *bson.M, op OplogOperation) error {
+		return errors.New("Broken")
+	})
+	esOps, err := NewEsOperations(indexes, []Manipulator{fail}, op)
+	if err != nil || len(esOps) != 1 {
+		t.Fatal("Expected one delete:", esOps, err)
+	}
+
+	bulk := elasticsearch.NewBulkBody(elasticsearch.MB)
+	if err := bulk.Add(esOps[0]); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(bulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := `{"delete":{"_index":"test","_type":"users","_id":"50eadae392cd864e50cd0dbc"}}` + "\n"
+	if string(b) != valid {
+		t.Errorf("\n'%s'\nNot equal to:\n'%s'", string(b), valid)
+	}
+}
+
+func TestEsOperationRouting(t *testing.T) {
+	defer func() { Routings = make(map[string]string) }()
+	owner := bson.ObjectIdHex("52e7db73f4eb27371874b289")
+	op := bsonToOperation(t, &bson.M{
+		"op": "u",
+		"ns": "test.photos",
+		"o2": bson.M{"_id": bson.ObjectIdHex("50eadae392cd864e50cd0dbc"), "owner": owner},
+		"o":  bson.M{"$set": bson.M{"title": "Sunset"}},
+	})
+
+	esOp := getEsOp(op)
+	if r, err := esOp.Routing(); err != nil || r != "" {
+		t.Error("Expected no routing without a configured field, got", r, err)
+	}
+	Routings["test.photos"] = "owner"
+	if r, err := esOp.Routing(); err != nil || r != owner.Hex() {
+		t.Error("Expected routing from the update target, got", r, err)
+	}
+}
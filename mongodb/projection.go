@@ -0,0 +1,109 @@
+package mongodb
+
+import (
+	"labix.org/v2/mgo/bson"
+	"path"
+	"strings"
+)
+
+// Projection limits which fields of a document are sent to ES. Fields are given as dotted paths
+// where each part may contain wildcards as understood by path.Match, for example "profile.*_hash".
+// A path matching a document also matches everything below it.
+type Projection struct {
+	// Include lists the only fields to keep, all fields are kept if it is empty.
+	Include []string `json:"include"`
+
+	// Exclude lists fields to remove, it takes precedence over Include.
+	Exclude []string `json:"exclude"`
+}
+
+// Apply returns a copy of the document with the projection applied. Keys containing dots, as used
+// by $set and $unset, are matched as if they were nested documents.
+func (p *Projection) Apply(doc bson.M) bson.M {
+	if p == nil || (len(p.Include) == 0 && len(p.Exclude) == 0) {
+		return doc
+	}
+	return p.apply(doc, nil, len(p.Include) == 0)
+}
+
+// apply filters the document found at prefix. included is true when a parent has already matched
+// Include, in which case only Exclude has to be checked.
+func (p *Projection) apply(doc bson.M, prefix []string, included bool) bson.M {
+	result := make(bson.M, len(doc))
+	for key, value := range doc {
+		parts := append(append([]string(nil), prefix...), strings.Split(key, ".")...)
+		if matchAny(p.Exclude, parts) {
+			continue
+		}
+		keep := included || matchAny(p.Include, parts)
+		if !keep && !prefixOfAny(p.Include, parts) {
+			continue
+		}
+
+		switch v := value.(type) {
+		case bson.M, map[string]interface{}:
+			sub, _ := asM(v)
+			sub = p.apply(sub, parts, keep)
+			if !keep && len(sub) == 0 {
+				continue
+			}
+			value = sub
+		case []interface{}:
+			value = p.applySlice(v, parts, keep)
+		default:
+			if !keep {
+				continue
+			}
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// applySlice filters any documents found in an array, other values are only kept if included.
+func (p *Projection) applySlice(values []interface{}, prefix []string, included bool) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		if sub, ok := asM(value); ok {
+			result = append(result, p.apply(sub, prefix, included))
+		} else if included {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// matchAny reports whether any of the patterns matches the path or one of its parents.
+func matchAny(patterns []string, parts []string) bool {
+	for _, pattern := range patterns {
+		patternParts := strings.Split(pattern, ".")
+		if len(patternParts) <= len(parts) && matchParts(patternParts, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixOfAny reports whether the path is a parent of something matched by any of the patterns.
+func prefixOfAny(patterns []string, parts []string) bool {
+	for _, pattern := range patterns {
+		patternParts := strings.Split(pattern, ".")
+		if len(patternParts) > len(parts) && matchParts(patternParts, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParts matches the path parts against as many pattern parts as both have.
+func matchParts(patternParts []string, parts []string) bool {
+	for i := 0; i < len(patternParts) && i < len(parts); i++ {
+		if ok, _ := path.Match(patternParts[i], parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Projections maps namespaces to the projection used for their documents.
+var Projections = make(map[string]*Projection)
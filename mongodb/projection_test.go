@@ -0,0 +1,95 @@
+package mongodb
+
+import (
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+)
+
+func TestProjectionExclude(t *testing.T) {
+	p := &Projection{Exclude: []string{"passwordHash", "profile.email", "*.secret"}}
+	doc := p.Apply(bson.M{
+		"alias":        "Johnny",
+		"passwordHash": "xxx",
+		"profile": bson.M{
+			"email": "johnny@example.com",
+			"city":  "Stockholm",
+		},
+		"tokens": bson.M{"secret": "s", "public": "p"},
+	})
+	valid := bson.M{
+		"alias":   "Johnny",
+		"profile": bson.M{"city": "Stockholm"},
+		"tokens":  bson.M{"public": "p"},
+	}
+	if !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
+
+func TestProjectionInclude(t *testing.T) {
+	p := &Projection{
+		Include: []string{"alias", "profile.city", "photos.url"},
+		Exclude: []string{"alias"},
+	}
+	doc := p.Apply(bson.M{
+		"alias": "Johnny",
+		"age":   30,
+		"profile": bson.M{
+			"email": "johnny@example.com",
+			"city":  "Stockholm",
+		},
+		"photos": []interface{}{
+			bson.M{"url": "a.jpg", "exif": "..."},
+		},
+	})
+	valid := bson.M{
+		"profile": bson.M{"city": "Stockholm"},
+		"photos":  []interface{}{bson.M{"url": "a.jpg"}},
+	}
+	if !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
+
+func TestProjectionDottedKeys(t *testing.T) {
+	p := &Projection{Include: []string{"profile"}, Exclude: []string{"profile.email"}}
+	doc := p.Apply(bson.M{
+		"profile.email": nil,
+		"profile.city":  "Stockholm",
+		"alias":         "Johnny",
+	})
+	valid := bson.M{"profile.city": "Stockholm"}
+	if !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
+
+func TestProjectionDocument(t *testing.T) {
+	defer func() { Projections = make(map[string]*Projection) }()
+	Projections["test.users"] = &Projection{Exclude: []string{"email", "deleted"}}
+
+	op := bsonToOperation(t, &bson.M{
+		"op": "u",
+		"ns": "test.users",
+		"o2": bson.M{"_id": bson.ObjectIdHex("52e7db73f4eb27371874b289")},
+		"o": bson.M{
+			"$set":   bson.M{"alias": "Johnny", "deleted": true},
+			"$unset": bson.M{"email": 1},
+		},
+	})
+	esOp := NewEsOperation(map[string]string{"test": "test"}, nil, op)
+	if a, _ := esOp.Action(); a != "delete" {
+		t.Error("Expected soft delete to be checked before projection, got", a)
+	}
+
+	op.Object["$set"] = bson.M{"alias": "Johnny"}
+	esOp = NewEsOperation(map[string]string{"test": "test"}, nil, op)
+	doc, err := esOp.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid := map[string]interface{}{"alias": "Johnny"}; !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
@@ -0,0 +1,181 @@
+package mongodb
+
+import (
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"math"
+	"strconv"
+	"time"
+)
+
+// RuleType selects what a Rule does to its field.
+type RuleType string
+
+const (
+	// Rename moves the field to the path given by To.
+	Rename RuleType = "rename"
+	// Convert changes the value of the field to the type given by As.
+	Convert RuleType = "convert"
+	// Default sets the field to Value when it is missing from an inserted document.
+	Default RuleType = "default"
+	// DropNull removes the field when it is null.
+	DropNull RuleType = "dropnull"
+)
+
+// Rule is one declarative change to a document, usually read from the config file rather than being
+// written as a Manipulator.
+type Rule struct {
+	Type RuleType `json:"type"`
+
+	// Field is the path the rule applies to, nested documents are separated by dots.
+	Field string `json:"field"`
+
+	// To is the new path of the field for Rename.
+	To string `json:"to"`
+
+	// As is what to convert the field into for Convert, one of:
+	// "hex" for object ids as hex strings, "epochms" for dates as milliseconds since epoch,
+	// "int", "float" or "string".
+	As string `json:"as"`
+
+	// Value is used by Default.
+	Value interface{} `json:"value"`
+}
+
+// Rules is a Manipulator applying each rule in order.
+type Rules []Rule
+
+func (rules Rules) Manipulate(doc *bson.M, op OplogOperation) error {
+	for _, rule := range rules {
+		if err := rule.apply(*doc, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if any of the rules are incomplete or of an unknown type.
+func (rules Rules) Validate() error {
+	for _, rule := range rules {
+		if rule.Field == "" {
+			return fmt.Errorf("Rule %s is missing a field", rule.Type)
+		}
+		switch rule.Type {
+		case Rename:
+			if rule.To == "" {
+				return fmt.Errorf("Rename of %s is missing to", rule.Field)
+			}
+		case Convert:
+			switch rule.As {
+			case "hex", "epochms", "int", "float", "string":
+			default:
+				return fmt.Errorf("Convert of %s has unknown type: %q", rule.Field, rule.As)
+			}
+		case Default, DropNull:
+		default:
+			return fmt.Errorf("Unknown rule type: %s", rule.Type)
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) apply(doc bson.M, op OplogOperation) error {
+	switch rule.Type {
+	case Rename:
+		if v, ok := deletePath(doc, rule.Field); ok {
+			setPath(doc, rule.To, v)
+		}
+	case Convert:
+		parent, key, ok := resolvePath(doc, rule.Field)
+		if !ok || parent[key] == nil {
+			return nil
+		}
+		v, err := convertValue(parent[key], rule.As)
+		if err != nil {
+			return fmt.Errorf("Could not convert %s: %s", rule.Field, err)
+		}
+		parent[key] = v
+	case Default:
+		// Updates only carry the changed fields, a missing field doesn't mean it's missing in ES.
+		if op != Insert {
+			return nil
+		}
+		if _, ok := lookupPath(doc, rule.Field); !ok {
+			setPath(doc, rule.Field, rule.Value)
+		}
+	case DropNull:
+		if v, ok := lookupPath(doc, rule.Field); ok && v == nil {
+			deletePath(doc, rule.Field)
+		}
+	default:
+		return fmt.Errorf("Unknown rule type: %s", rule.Type)
+	}
+	return nil
+}
+
+// convertValue converts v, or each value in v if it is an array.
+func convertValue(v interface{}, as string) (interface{}, error) {
+	if values, ok := v.([]interface{}); ok {
+		converted := make([]interface{}, len(values))
+		for i, value := range values {
+			c, err := convertValue(value, as)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = c
+		}
+		return converted, nil
+	}
+
+	switch as {
+	case "hex":
+		switch id := v.(type) {
+		case bson.ObjectId:
+			return id.Hex(), nil
+		case string:
+			return id, nil
+		}
+	case "epochms":
+		if t, ok := v.(time.Time); ok {
+			return t.UnixMilli(), nil
+		}
+	case "int":
+		switch n := v.(type) {
+		case string:
+			return strconv.ParseInt(n, 10, 64)
+		case float64:
+			// Outside of this range the conversion isn't defined.
+			if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+				return nil, fmt.Errorf("%v is not an integer", n)
+			}
+			return int64(n), nil
+		case int, int32, int64:
+			return n, nil
+		}
+	case "float":
+		switch n := v.(type) {
+		case string:
+			return strconv.ParseFloat(n, 64)
+		case int:
+			return float64(n), nil
+		case int32:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "string":
+		if id, ok := v.(bson.ObjectId); ok {
+			return id.Hex(), nil
+		}
+		return fmt.Sprint(v), nil
+	default:
+		return nil, fmt.Errorf("unknown conversion %q", as)
+	}
+	return nil, fmt.Errorf("can't convert %T to %s", v, as)
+}
+
+// NamespaceManipulators are run after the manipulators of an EsOperation for documents in the mapped
+// namespace.
+var NamespaceManipulators = make(map[string][]Manipulator)
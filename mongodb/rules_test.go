@@ -0,0 +1,101 @@
+package mongodb
+
+import (
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	owner := bson.ObjectIdHex("52e7db73f4eb27371874b289")
+	rules := Rules{
+		{Type: Rename, Field: "_t", To: "kind"},
+		{Type: Convert, Field: "owner", As: "hex"},
+		{Type: Convert, Field: "friends", As: "hex"},
+		{Type: Convert, Field: "created_at", As: "epochms"},
+		{Type: Convert, Field: "profile.age", As: "int"},
+		{Type: Default, Field: "visible", Value: true},
+		{Type: DropNull, Field: "photo"},
+	}
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := bson.M{
+		"_t":         "User",
+		"owner":      owner,
+		"friends":    []interface{}{owner},
+		"created_at": time.Date(2014, time.February, 25, 10, 46, 24, 0, time.UTC),
+		"profile":    bson.M{"age": "30"},
+		"photo":      nil,
+	}
+	if err := rules.Manipulate(&doc, Insert); err != nil {
+		t.Fatal(err)
+	}
+	valid := bson.M{
+		"kind":       "User",
+		"owner":      owner.Hex(),
+		"friends":    []interface{}{owner.Hex()},
+		"created_at": int64(1393325184000),
+		"profile":    bson.M{"age": int64(30)},
+		"visible":    true,
+	}
+	if !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
+
+func TestRulesUpdate(t *testing.T) {
+	rules := Rules{
+		{Type: Default, Field: "visible", Value: true},
+		{Type: Convert, Field: "profile.age", As: "int"},
+	}
+	doc := bson.M{"profile.age": "31"}
+	if err := rules.Manipulate(&doc, Update); err != nil {
+		t.Fatal(err)
+	}
+	if valid := (bson.M{"profile.age": int64(31)}); !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+
+	doc = bson.M{"profile.age": "thirty"}
+	if err := rules.Manipulate(&doc, Update); err == nil {
+		t.Error("Expected an error converting a non numeric string")
+	}
+
+	doc = bson.M{"profile.age": 30.5}
+	if err := rules.Manipulate(&doc, Update); err == nil {
+		t.Error("Expected an error converting a fraction to int")
+	}
+	doc = bson.M{"profile.age": 31.0}
+	if err := rules.Manipulate(&doc, Update); err != nil || doc["profile.age"] != int64(31) {
+		t.Error("Expected a whole float to be converted:", doc, err)
+	}
+}
+
+func TestRulesConvertEpochms(t *testing.T) {
+	rules := Rules{{Type: Convert, Field: "at", As: "epochms"}}
+	at := time.Date(2400, time.January, 1, 0, 0, 0, 0, time.UTC)
+	doc := bson.M{"at": at}
+	if err := rules.Manipulate(&doc, Insert); err != nil {
+		t.Fatal(err)
+	}
+	if doc["at"] != at.Unix()*1000 {
+		t.Error("Expected milliseconds since epoch, got", doc["at"])
+	}
+}
+
+func TestRulesValidate(t *testing.T) {
+	invalid := []Rules{
+		{{Type: "explode", Field: "a"}},
+		{{Type: Rename, Field: "a"}},
+		{{Type: Convert, Field: "a", As: "roman"}},
+		{{Type: DropNull}},
+	}
+	for _, rules := range invalid {
+		if err := rules.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rules)
+		}
+	}
+}
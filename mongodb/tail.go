@@ -2,10 +2,12 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
+	"github.com/duego/cryriver/stats"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
-	"log"
+	"log/slog"
 	"strings"
 )
 
@@ -25,9 +27,36 @@ func Optime(s *mgo.Session) (*Timestamp, error) {
 	return ts, nil
 }
 
+// PendingOperations returns the timestamp of the first oplog entry for the namespace after ts, zero
+// if there is none, and how many entries there are after ts, counting no further than max. Only the
+// oplog after ts is read, as the oplog has no index on the namespace to count with.
+func PendingOperations(s *mgo.Session, ns string, ts Timestamp, max int) (first Timestamp, n int, err error) {
+	if max < 1 {
+		max = 1
+	}
+	iter := s.DB("local").C("oplog.rs").Find(bson.M{"ns": ns, "ts": bson.M{"$gt": ts}}).
+		Select(bson.M{"ts": 1}).LogReplay().Limit(max).Iter()
+	var entry struct {
+		Timestamp Timestamp `bson:"ts"`
+	}
+	for iter.Next(&entry) {
+		if n == 0 {
+			first = entry.Timestamp
+		}
+		n++
+	}
+	return first, n, iter.Close()
+}
+
 // Tail sends mongodb operations for the namespace on the specified channel.
-// Interrupts tailing if exit chan closes.
-func Tail(session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc chan<- *Operation, exit chan bool) error {
+// Interrupts tailing once ctx is done. A nil logger uses slog.Default(). Every operation sent
+// starts a trace span, which the receiver ends with Done. An initial import is followed by an
+// ImportDone operation, before tailing from when the import started.
+func Tail(ctx context.Context, session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc chan<- *Operation, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With("namespace", ns)
 	defer close(opc)
 	defer session.Close()
 
@@ -48,30 +77,39 @@ func Tail(session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc
 		if len(nsParts) != 2 {
 			return errors.New("Exected namespace provided as database.collection")
 		}
+		// Like the tail cursor, the import cursor doesn't time out while the river is paused.
+		session.SetCursorTimeout(0)
 		col := session.DB(nsParts[0]).C(nsParts[1])
 		iter := col.Find(nil).Iter()
 		initialDone := make(chan bool)
 		go func() {
-			log.Println("Doing initial import, this may take a while...")
+			stats.Phase.Set("initial import")
+			logger.Info("Doing initial import, this may take a while...", "ts", *lastTs)
 			var count uint64
 			for {
 				var result bson.M
 				if iter.Next(&result) {
-					select {
-					case opc <- &Operation{
+					op := &Operation{
+						Timestamp: *lastTs,
 						Namespace: ns,
 						Op:        Insert,
 						Object:    result,
-					}:
+						Initial:   true,
+					}
+					op.startSpan()
+					select {
+					case opc <- op:
 						count++
-					case <-exit:
+						stats.Operations.Inc(ns, Insert.Name())
+					case <-ctx.Done():
+						op.Done(nil)
 						break
 					}
 				} else {
 					break
 				}
 			}
-			log.Println("Initial import object count:", count)
+			logger.Info("Initial import read all objects", "count", count)
 			close(initialDone)
 		}()
 
@@ -83,21 +121,30 @@ func Tail(session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc
 					return err
 				}
 				break waitInitialSync
-			case <-exit:
-				log.Println("Initial import was interrupted")
+			case <-ctx.Done():
+				logger.Warn("Initial import was interrupted")
 				err := iter.Close()
 				<-initialDone
 				return err
 			}
 		}
-		log.Println("Initial import has completed")
+		logger.Info("Initial import has completed")
+		select {
+		case opc <- &Operation{Timestamp: *lastTs, Namespace: ns, Op: ImportDone}:
+		case <-ctx.Done():
+			return nil
+		}
 	}
 
-	// Start tailing oplog
-	col := session.DB("local").C("oplog.rs")
+	// Start tailing oplog. The cursor doesn't time out on the server while operations aren't being
+	// received, e.g. while the river is paused.
+	tailSession := session.Copy()
+	defer tailSession.Close()
+	tailSession.SetCursorTimeout(0)
+	col := tailSession.DB("local").C("oplog.rs")
 
-	log.Println("Resuming oplog from timestamp:", *lastTs)
-	log.Println("It could take a moment for MongoDB to scan through the oplog collection...")
+	stats.Phase.Set("tailing")
+	logger.Info("Resuming oplog, it could take a moment for MongoDB to scan through the oplog collection...", "ts", *lastTs)
 	query := bson.M{"ns": ns, "ts": bson.M{"$gt": *lastTs}}
 
 	// Start tailing, sorted by forward natural order by default in capped collections.
@@ -107,9 +154,12 @@ func Tail(session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc
 		for {
 			var result Operation
 			if iter.Next(&result) {
+				result.startSpan()
 				select {
 				case opc <- &result:
-				case <-exit:
+					stats.Operations.Inc(result.Namespace, result.Op.Name())
+				case <-ctx.Done():
+					result.Done(nil)
 					break
 				}
 			} else {
@@ -119,9 +169,9 @@ func Tail(session *mgo.Session, ns string, initial bool, lastTs *Timestamp, opc
 		close(iterClosed)
 	}()
 
-	// Block until we are supposed to exit, close the iterator when that happens
+	// Block until ctx is done, close the iterator when that happens
 	select {
-	case <-exit:
+	case <-ctx.Done():
 	case <-iterClosed:
 	}
 	err := iter.Close()
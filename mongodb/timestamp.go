@@ -5,12 +5,32 @@ import (
 	"io"
 	"io/ioutil"
 	"labix.org/v2/mgo/bson"
+	"log/slog"
 	"strconv"
 	"time"
 )
 
 type Timestamp bson.MongoTimestamp
 
+// NewTimestamp returns the timestamp of the operation with the ordinal in the second of t. Ordinals
+// start at 1, so the ordinal 0 is before any operation in that second.
+func NewTimestamp(t time.Time, ordinal uint32) Timestamp {
+	return Timestamp(t.Unix()<<32 | int64(ordinal))
+}
+
+// ParseTimestamp reads a timestamp either as the number written by Save, or as a time in RFC 3339
+// format which is before any operation in that second.
+func ParseTimestamp(s string) (Timestamp, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Timestamp(i), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timestamp %q, expected a number or a time like 2014-02-25T10:46:24Z", s)
+	}
+	return NewTimestamp(t, 0), nil
+}
+
 // Time converts a mongo timestamp to Time with UTC selected as timezone.
 func (t *Timestamp) Time() *time.Time {
 	// Mongo special timestamp: First 32 bits are seconds, last 32 bits are a counter in a second.
@@ -35,6 +55,11 @@ func (t Timestamp) String() string {
 	return fmt.Sprintf("%s Ordinal: %d", t.Time(), t.Ordinal())
 }
 
+// LogValue logs the timestamp the same way as String.
+func (t Timestamp) LogValue() slog.Value {
+	return slog.StringValue(t.String())
+}
+
 // Save writes the timestamp as a string using io.Writer.
 func (t Timestamp) Save(w io.Writer) error {
 	ts := []byte(strconv.FormatInt(int64(t), 10))
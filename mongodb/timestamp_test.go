@@ -46,3 +46,23 @@ func TestLoadTimestamp(t *testing.T) {
 	}
 
 }
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := ParseTimestamp("5984286097973182465")
+	if err != nil || int64(ts) != 5984286097973182465 {
+		t.Error("Expected a number to be read as is, got", int64(ts), err)
+	}
+
+	ts, err = ParseTimestamp("2014-02-25T10:46:24Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := time.Date(2014, time.February, 25, 10, 46, 24, 0, time.UTC)
+	if !ts.Time().Equal(valid) || int64(ts) != 5984286097973182464 {
+		t.Error("Expected the timestamp before the first operation at", valid, "got", int64(ts))
+	}
+
+	if _, err := ParseTimestamp("yesterday"); err == nil {
+		t.Error("Expected an error for an invalid timestamp")
+	}
+}
@@ -0,0 +1,48 @@
+package mongodb
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are sent to the global tracer provider, nothing is recorded unless one has been set.
+var tracer = otel.Tracer("github.com/duego/cryriver/mongodb")
+
+// startSpan starts the span that follows the operation from being read until it has been handed over
+// to elasticsearch.
+func (op *Operation) startSpan() {
+	op.ctx, _ = tracer.Start(context.Background(), "operation",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("namespace", op.Namespace),
+			attribute.String("op", op.Op.Name()),
+			attribute.Int64("ts", int64(op.Timestamp)),
+			attribute.Bool("initial", op.Initial),
+		))
+	if id, err := op.ObjectId(); err == nil {
+		trace.SpanFromContext(op.ctx).SetAttributes(attribute.String("_id", id.Hex()))
+	}
+}
+
+// Context returns the context carrying the span of the operation, started when it was read from
+// MongoDB. Spans of what is done with the operation should be started from it.
+func (op *Operation) Context() context.Context {
+	if op.ctx == nil {
+		return context.Background()
+	}
+	return op.ctx
+}
+
+// Done ends the span of the operation, call it once it has been handed to elasticsearch or dropped
+// because of err.
+func (op *Operation) Done(err error) {
+	span := trace.SpanFromContext(op.Context())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,55 @@
+package mongodb
+
+import (
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+// Spans of all tests end up here, the global provider can only be set once for the package tracer.
+var spans = tracetest.NewSpanRecorder()
+
+func init() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+}
+
+func TestOperationSpan(t *testing.T) {
+	before := len(spans.Ended())
+	op := &Operation{
+		Namespace: "testing.users",
+		Op:        Insert,
+		Object:    bson.M{"_id": bson.NewObjectId(), "name": "Anna"},
+	}
+	op.startSpan()
+	if _, err := NewEsOperations(map[string]string{"testing": "testing"}, nil, op); err != nil {
+		t.Fatal(err)
+	}
+	op.Done(errors.New("Dropped"))
+
+	ended := spans.Ended()[before:]
+	if len(ended) != 2 {
+		t.Fatal("Expected 2 spans, got", len(ended))
+	}
+	transform, operation := ended[0], ended[1]
+	if transform.Name() != "transform" || operation.Name() != "operation" {
+		t.Fatal("Unexpected spans", transform.Name(), operation.Name())
+	}
+	if transform.Parent().SpanID() != operation.SpanContext().SpanID() {
+		t.Error("Expected transform to be a child of the operation span")
+	}
+	if operation.Status().Code != codes.Error {
+		t.Error("Expected the error to be recorded on the operation span")
+	}
+}
+
+func TestOperationWithoutSpan(t *testing.T) {
+	op := &Operation{}
+	if op.Context() == nil {
+		t.Error("Expected a context without a span")
+	}
+	op.Done(nil)
+}
@@ -2,6 +2,7 @@ package mongodb
 
 import (
 	"labix.org/v2/mgo/bson"
+	"strings"
 )
 
 type BsonTraverser struct {
@@ -33,3 +34,74 @@ func (b BsonTraverser) Next(key string) BsonTraverser {
 func (b BsonTraverser) Value() interface{} {
 	return b.value
 }
+
+// lookupPath finds the value at a dotted path, both nested documents and keys containing dots
+// (as used by $set) are resolved. Returns false if the path doesn't exist.
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	parent, key, ok := resolvePath(doc, path)
+	if !ok {
+		return nil, false
+	}
+	return parent[key], true
+}
+
+// resolvePath finds the document holding the last part of a dotted path and the key used for it.
+func resolvePath(doc bson.M, path string) (bson.M, string, bool) {
+	if _, ok := doc[path]; ok {
+		return doc, path, true
+	}
+	parts := strings.Split(path, ".")
+	for i := len(parts) - 1; i > 0; i-- {
+		v, ok := doc[strings.Join(parts[:i], ".")]
+		if !ok {
+			continue
+		}
+		if sub, ok := asM(v); ok {
+			if parent, key, ok := resolvePath(sub, strings.Join(parts[i:], ".")); ok {
+				return parent, key, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// setPath sets the value at a dotted path, replacing any existing value. Missing documents on the
+// way are created.
+func setPath(doc bson.M, path string, value interface{}) {
+	if parent, key, ok := resolvePath(doc, path); ok {
+		parent[key] = value
+		return
+	}
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := asM(doc[part])
+		if !ok {
+			sub = make(bson.M)
+			doc[part] = sub
+		}
+		doc = sub
+	}
+	doc[parts[len(parts)-1]] = value
+}
+
+// deletePath removes the value at a dotted path, returning the removed value.
+func deletePath(doc bson.M, path string) (interface{}, bool) {
+	parent, key, ok := resolvePath(doc, path)
+	if !ok {
+		return nil, false
+	}
+	v := parent[key]
+	delete(parent, key)
+	return v, true
+}
+
+// asM returns v as a bson.M if it is any kind of string map.
+func asM(v interface{}) (bson.M, bool) {
+	switch t := v.(type) {
+	case bson.M:
+		return t, true
+	case map[string]interface{}:
+		return bson.M(t), true
+	}
+	return nil, false
+}
@@ -1,52 +1,124 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	"github.com/duego/cryriver/mongodb"
-	"log"
+	"github.com/duego/cryriver/stats"
+	"log/slog"
+	"math"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	lastEsSeen     *mongodb.Timestamp
-	lastEsSeenC    = make(chan *mongodb.Timestamp, 1)
+	// What elasticsearch has acknowledged, saved as progress.
+	progress       = new(watermark)
 	lastEsSeenStat = expvar.NewString("Last optime seen")
+	checkpointNow  = make(chan chan error)
+
+	// Closed when the checkpointer has stopped.
+	checkpointerDone = make(chan bool)
+
+	// The last saved timestamp, read by metrics.
+	lastSaved int64
+	// Whether anything has been saved yet, only used by the checkpointer.
+	saved bool
 )
 
-func init() {
-	// Restore any previously saved timestamp
-	lastEsSeen = new(mongodb.Timestamp)
+// startCheckpointer restores any previously saved timestamp, which is returned, and starts saving
+// the progress acknowledged by elasticsearch until ctx is done.
+func startCheckpointer(ctx context.Context, logger *slog.Logger) *mongodb.Timestamp {
+	logger = logger.With("file", *optimeStore)
+	restored := new(mongodb.Timestamp)
 	if f, err := os.Open(*optimeStore); err != nil {
-		log.Println("Failed to load previous lastEsSeen timestamp:", err)
+		logger.Warn("Failed to load previous oplog timestamp", "err", err)
 	} else {
-		lastEsSeen.Load(f)
+		restored.Load(f)
 		f.Close()
+		logger.Info("Loaded previous oplog timestamp", "ts", *restored)
+	}
+	progress.reset(*restored)
+	checkpointerDone = make(chan bool)
+	stats.CheckpointAge.Func(checkpointAge)
+	go saveLastEsSeen(ctx, logger)
+	return restored
+}
+
+// checkpointAge returns the age of the last saved timestamp in seconds, NaN if none is saved.
+func checkpointAge() float64 {
+	ts := mongodb.Timestamp(atomic.LoadInt64(&lastSaved))
+	if ts == 0 {
+		return math.NaN()
 	}
-	go saveLastEsSeen()
+	return time.Since(*ts.Time()).Seconds()
 }
 
-// saveLastEsSeen loops the channel to save our progress on what timestamp we have seen so far.
-// It will be flushed to disk when our timer ticks.
-func saveLastEsSeen() {
+// saveLastEsSeen saves our progress on what timestamp elasticsearch has acknowledged so far.
+// It will be flushed to disk when our timer ticks, or when asked to on checkpointNow.
+func saveLastEsSeen(ctx context.Context, logger *slog.Logger) {
+	defer close(checkpointerDone)
 	lastEsSeenTimer := time.NewTicker(time.Second)
+	defer lastEsSeenTimer.Stop()
 	for {
 		select {
 		case <-lastEsSeenTimer.C:
-			if lastEsSeen == nil {
-				continue
+			if err := saveCheckpoint(); err != nil {
+				logger.Error("Error saving oplog timestamp", "ts", progress.Acked(), "err", err)
 			}
-			if f, err := os.Create(*optimeStore); err != nil {
-				log.Println("Error saving oplog timestamp:", err)
-			} else {
-				if err := lastEsSeen.Save(f); err != nil {
-					log.Println("Error saving oplog timestamp:", err)
-				}
-				f.Close()
-				lastEsSeenStat.Set(lastEsSeen.String())
-				lastEsSeen = nil
-			}
-		case lastEsSeen = <-lastEsSeenC:
+		case done := <-checkpointNow:
+			done <- saveCheckpoint()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
+
+// saveCheckpoint writes the acknowledged progress to disk, unless it was already saved.
+func saveCheckpoint() error {
+	ts := progress.Acked()
+	if saved && int64(ts) == atomic.LoadInt64(&lastSaved) {
+		return nil
+	}
+	f, err := os.Create(*optimeStore)
+	if err != nil {
+		return err
+	}
+	err = ts.Save(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	lastEsSeenStat.Set(ts.String())
+	atomic.StoreInt64(&lastSaved, int64(ts))
+	saved = true
+	return nil
+}
+
+// checkpoint makes the checkpointer save progress right away and returns the saved timestamp.
+func checkpoint(ctx context.Context) (mongodb.Timestamp, error) {
+	done := make(chan error, 1)
+	select {
+	case checkpointNow <- done:
+	case <-checkpointerDone:
+		return 0, ShuttingDown
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return mongodb.Timestamp(atomic.LoadInt64(&lastSaved)), err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// stopCheckpointer stops saving progress by calling cancel for the context of the checkpointer, after
+// saving it a last time. Returns the last saved timestamp.
+func stopCheckpointer(cancel context.CancelFunc) (mongodb.Timestamp, error) {
+	_, err := checkpoint(context.Background())
+	cancel()
+	<-checkpointerDone
+	return mongodb.Timestamp(atomic.LoadInt64(&lastSaved)), err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(store string) { *optimeStore = store }(*optimeStore)
+	*optimeStore = filepath.Join(dir, "cryriver.db")
+	if err := ioutil.WriteFile(*optimeStore, []byte("5"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if restored := startCheckpointer(ctx, slog.Default()); *restored != 5 {
+		t.Fatal("Expected the saved timestamp to be restored, got", *restored)
+	}
+
+	// Only what elasticsearch acknowledged is saved.
+	first, second := progress.add(6, 1), progress.add(7, 1)
+	second.Acknowledge(nil)
+	if ts, err := checkpoint(ctx); err != nil || ts != 5 {
+		t.Error("Expected the restored timestamp to be saved, got", ts, err)
+	}
+	first.Acknowledge(nil)
+	if ts, err := checkpoint(ctx); err != nil || ts != 7 {
+		t.Error("Expected the acknowledged timestamp to be saved, got", ts, err)
+	}
+	if b, _ := ioutil.ReadFile(*optimeStore); string(b) != "7" {
+		t.Error("Expected the acknowledged timestamp in the file, got", string(b))
+	}
+
+	if ts, err := stopCheckpointer(cancel); err != nil || ts != 7 {
+		t.Error("Expected the final checkpoint to be saved, got", ts, err)
+	}
+	if _, err := checkpoint(context.Background()); err != ShuttingDown {
+		t.Error("Expected checkpoints to fail once stopped, got", err)
+	}
+}
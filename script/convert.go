@@ -0,0 +1,145 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"go.starlark.net/starlark"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// toStarlark converts a document value into its Starlark counterpart.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch t := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(t), nil
+	case string:
+		return starlark.String(t), nil
+	case int:
+		return starlark.MakeInt(t), nil
+	case int32:
+		return starlark.MakeInt64(int64(t)), nil
+	case int64:
+		return starlark.MakeInt64(t), nil
+	case float64:
+		return starlark.Float(t), nil
+	case bson.M:
+		return mapToStarlark(t)
+	case map[string]interface{}:
+		return mapToStarlark(bson.M(t))
+	case []interface{}:
+		values := make([]starlark.Value, len(t))
+		for i, value := range t {
+			sv, err := toStarlark(value)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = sv
+		}
+		return starlark.NewList(values), nil
+	}
+	return goValue{v}, nil
+}
+
+func mapToStarlark(m bson.M) (starlark.Value, error) {
+	dict := starlark.NewDict(len(m))
+	for key, value := range m {
+		sv, err := toStarlark(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := dict.SetKey(starlark.String(key), sv); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+// fromStarlark converts a value returned by a script back into a document value.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch t := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(t), nil
+	case starlark.String:
+		return string(t), nil
+	case starlark.Int:
+		if i, ok := t.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("int %s is too large", t)
+	case starlark.Float:
+		return float64(t), nil
+	case *starlark.Dict:
+		m := make(bson.M, t.Len())
+		for _, item := range t.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", item[0])
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case *starlark.List:
+		return fromIterable(t, t.Len())
+	case starlark.Tuple:
+		return fromIterable(t, t.Len())
+	case goValue:
+		return t.v, nil
+	}
+	return nil, fmt.Errorf("can't use %s in a document", v.Type())
+}
+
+func fromIterable(iterable starlark.Iterable, n int) ([]interface{}, error) {
+	values := make([]interface{}, 0, n)
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		value, err := fromStarlark(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// goValue wraps values that scripts can't change but should be able to pass along, like object ids.
+type goValue struct {
+	v interface{}
+}
+
+func (g goValue) String() string {
+	switch t := g.v.(type) {
+	case bson.ObjectId:
+		return t.Hex()
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(g.v)
+}
+
+func (g goValue) Type() string {
+	switch g.v.(type) {
+	case bson.ObjectId:
+		return "objectid"
+	case time.Time:
+		return "time"
+	}
+	return fmt.Sprintf("%T", g.v)
+}
+
+func (g goValue) Freeze()              {}
+func (g goValue) Truth() starlark.Bool { return starlark.True }
+
+func (g goValue) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: " + g.Type())
+}
@@ -0,0 +1,157 @@
+// Package script transforms documents with Starlark scripts loaded at startup, making it possible to
+// change documents without building a custom binary.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duego/cryriver/mongodb"
+	"go.starlark.net/starlark"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultMaxSteps bounds the Starlark computation steps of one transform call.
+	DefaultMaxSteps = 10000000
+	// DefaultTimeout bounds the time of one transform call.
+	DefaultTimeout = 5 * time.Second
+)
+
+// Script is a mongodb.Manipulator calling the transform function defined in a Starlark file:
+//
+//	def transform(doc, op, ns):
+//		doc["kind"] = doc.pop("_t", None)
+//		return doc
+//
+// doc is a dict of the inserted document or the changed fields of an update, op is the oplog
+// operation ("i" or "u") and ns is the namespace. The function should return one of:
+//
+//	a dict replacing the document
+//	skip, to not send the operation to ES
+//	reroute(index, doc), to send the document to another index
+//
+// Values without a Starlark counterpart, such as object ids and dates, are passed through untouched
+// unless the script replaces them. str() returns their hex or RFC 3339 form.
+//
+// A call that runs for more than MaxSteps steps or Timeout, or is still running when the context
+// given to Load is done, is cancelled and fails the operation.
+type Script struct {
+	// Namespace is passed to the transform function.
+	Namespace string
+
+	MaxSteps uint64
+	Timeout  time.Duration
+
+	ctx       context.Context
+	filename  string
+	transform starlark.Callable
+}
+
+// Load executes a script file and returns a Script using its transform function. Calls still running
+// when ctx is done are cancelled.
+func Load(ctx context.Context, filename, ns string) (*Script, error) {
+	thread := &starlark.Thread{Name: filename, Print: printer}
+	thread.SetMaxExecutionSteps(DefaultMaxSteps)
+	defer context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })()
+	globals, err := starlark.ExecFile(thread, filename, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	transform, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: no transform function defined", filename)
+	}
+	return &Script{
+		Namespace: ns,
+		MaxSteps:  DefaultMaxSteps,
+		Timeout:   DefaultTimeout,
+		ctx:       ctx,
+		filename:  filename,
+		transform: transform,
+	}, nil
+}
+
+func (s *Script) Manipulate(doc *bson.M, op mongodb.OplogOperation) error {
+	in, err := toStarlark(*doc)
+	if err != nil {
+		return err
+	}
+	thread := &starlark.Thread{Name: s.filename, Print: printer}
+	thread.SetMaxExecutionSteps(s.MaxSteps)
+	timeout := time.AfterFunc(s.Timeout, func() { thread.Cancel("timed out after " + s.Timeout.String()) })
+	defer timeout.Stop()
+	defer context.AfterFunc(s.ctx, func() { thread.Cancel(s.ctx.Err().Error()) })()
+	args := starlark.Tuple{in, starlark.String(op), starlark.String(s.Namespace)}
+	result, err := starlark.Call(thread, s.transform, args, nil)
+	if err != nil {
+		return err
+	}
+
+	switch r := result.(type) {
+	case skipValue:
+		return mongodb.SkipOperation
+	case *rerouteValue:
+		if err := s.replace(doc, r.doc); err != nil {
+			return err
+		}
+		return mongodb.Reroute{Index: r.index}
+	default:
+		return s.replace(doc, result)
+	}
+}
+
+// replace sets the document to what the script returned.
+func (s *Script) replace(doc *bson.M, v starlark.Value) error {
+	out, err := fromStarlark(v)
+	if err != nil {
+		return err
+	}
+	m, ok := out.(bson.M)
+	if !ok {
+		return fmt.Errorf("%s: transform returned %s, expected a dict", s.filename, v.Type())
+	}
+	*doc = m
+	return nil
+}
+
+func printer(thread *starlark.Thread, msg string) {
+	log.Println(thread.Name+":", msg)
+}
+
+var predeclared = starlark.StringDict{
+	"skip":    skipValue{},
+	"reroute": starlark.NewBuiltin("reroute", reroute),
+}
+
+// skipValue is returned by scripts that don't want the operation sent.
+type skipValue struct{}
+
+func (skipValue) String() string        { return "skip" }
+func (skipValue) Type() string          { return "skip" }
+func (skipValue) Freeze()               {}
+func (skipValue) Truth() starlark.Bool  { return starlark.True }
+func (skipValue) Hash() (uint32, error) { return 0, errors.New("unhashable type: skip") }
+
+// rerouteValue is returned by reroute(index, doc).
+type rerouteValue struct {
+	index string
+	doc   starlark.Value
+}
+
+func reroute(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var index string
+	var doc *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "index", &index, "doc", &doc); err != nil {
+		return nil, err
+	}
+	return &rerouteValue{index, doc}, nil
+}
+
+func (r *rerouteValue) String() string        { return fmt.Sprintf("reroute(%q)", r.index) }
+func (r *rerouteValue) Type() string          { return "reroute" }
+func (r *rerouteValue) Freeze()               { r.doc.Freeze() }
+func (r *rerouteValue) Truth() starlark.Bool  { return starlark.True }
+func (r *rerouteValue) Hash() (uint32, error) { return 0, errors.New("unhashable type: reroute") }
@@ -0,0 +1,149 @@
+package script
+
+import (
+	"context"
+	"github.com/duego/cryriver/mongodb"
+	"io/ioutil"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScript = `
+def transform(doc, op, ns):
+    if doc.get("hidden"):
+        return skip
+    doc["kind"] = doc.pop("_t", None)
+    doc["ns"] = ns
+    doc["op"] = op
+    doc["owner_hex"] = str(doc["owner"])
+    if doc.get("search"):
+        return reroute("users_search", doc)
+    return doc
+`
+
+func loadTestScript(t *testing.T) *Script {
+	return loadScript(t, context.Background(), testScript)
+}
+
+func loadScript(t *testing.T, ctx context.Context, src string) *Script {
+	dir, err := ioutil.TempDir("", "cryriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "transform.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(ctx, filename, "test.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScriptTransform(t *testing.T) {
+	s := loadTestScript(t)
+	owner := bson.ObjectIdHex("52e7db73f4eb27371874b289")
+	created := time.Date(2014, time.February, 25, 10, 46, 24, 0, time.UTC)
+	doc := bson.M{
+		"_t":         "User",
+		"owner":      owner,
+		"created_at": created,
+		"age":        30,
+		"tags":       []interface{}{"a", bson.M{"b": 1.5}},
+	}
+	if err := s.Manipulate(&doc, mongodb.Insert); err != nil {
+		t.Fatal(err)
+	}
+	valid := bson.M{
+		"kind":       "User",
+		"ns":         "test.users",
+		"op":         "i",
+		"owner":      owner,
+		"owner_hex":  owner.Hex(),
+		"created_at": created,
+		"age":        int64(30),
+		"tags":       []interface{}{"a", bson.M{"b": 1.5}},
+	}
+	if !reflect.DeepEqual(doc, valid) {
+		t.Errorf("\n%v\nNot equal to:\n%v", doc, valid)
+	}
+}
+
+func TestScriptSkip(t *testing.T) {
+	s := loadTestScript(t)
+	doc := bson.M{"hidden": true}
+	if err := s.Manipulate(&doc, mongodb.Update); err != mongodb.SkipOperation {
+		t.Error("Expected operation to be skipped, got", err)
+	}
+}
+
+func TestScriptReroute(t *testing.T) {
+	s := loadTestScript(t)
+	doc := bson.M{"owner": "x", "search": true}
+	err := s.Manipulate(&doc, mongodb.Update)
+	if r, ok := err.(mongodb.Reroute); !ok || r.Index != "users_search" {
+		t.Error("Expected operation to be rerouted, got", err)
+	}
+	if doc["kind"] != nil || doc["owner_hex"] != "x" {
+		t.Error("Expected document to be changed when rerouted:", doc)
+	}
+}
+
+func TestScriptError(t *testing.T) {
+	s := loadScript(t, context.Background(), `
+def transform(doc, op, ns):
+    fail("broken")
+`)
+	op := &mongodb.Operation{
+		Op:        mongodb.Insert,
+		Namespace: "test.users",
+		Object:    bson.M{"_id": bson.ObjectIdHex("52e7db73f4eb27371874b289")},
+	}
+	esOps, err := mongodb.NewEsOperations(map[string]string{"test": "test"}, []mongodb.Manipulator{s}, op)
+	if err == nil || !strings.Contains(err.Error(), "broken") || len(esOps) != 0 {
+		t.Error("Expected the error of the script, got", esOps, err)
+	}
+}
+
+const loopScript = `
+def transform(doc, op, ns):
+    for i in range(1 << 60):
+        pass
+    return doc
+`
+
+func TestScriptMaxSteps(t *testing.T) {
+	s := loadScript(t, context.Background(), loopScript)
+	s.MaxSteps = 1000
+	doc := bson.M{}
+	if err := s.Manipulate(&doc, mongodb.Insert); err == nil {
+		t.Error("Expected the script to be cancelled")
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	s := loadScript(t, context.Background(), loopScript)
+	s.MaxSteps, s.Timeout = 0, 10*time.Millisecond
+	doc := bson.M{}
+	if err := s.Manipulate(&doc, mongodb.Insert); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Error("Expected the script to time out, got", err)
+	}
+}
+
+func TestScriptCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := loadScript(t, ctx, loopScript)
+	s.MaxSteps, s.Timeout = 0, time.Hour
+	time.AfterFunc(10*time.Millisecond, cancel)
+	doc := bson.M{}
+	if err := s.Manipulate(&doc, mongodb.Insert); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Error("Expected the script to be cancelled, got", err)
+	}
+}
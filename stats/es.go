@@ -7,4 +7,39 @@ import (
 var (
 	BulkFull = expvar.NewInt("bulk full")
 	BulkTime = expvar.NewInt("bulk time")
+	BulkOps  = expvar.NewInt("bulk ops")
+
+	// Limits adapted to elasticsearch rejecting requests
+	BulkRejected = expvar.NewInt("bulk rejected")
+	BulkRequests = expvar.NewInt("bulk requests allowed")
+	BulkMaxBytes = expvar.NewInt("bulk max bytes")
+
+	// Size of the slurper pool and the moving average of bulk request latency
+	Slurpers    = expvar.NewInt("slurpers")
+	BulkLatency = expvar.NewInt("bulk latency ms")
+)
+
+// Prometheus metrics, see Handler.
+var (
+	BulkFlushes = NewCounter("cryriver_bulk_flushes_total",
+		"Bulk requests started, by what triggered them: size, ops, age, flush or close.", "trigger")
+	BulkDuration = NewHistogram("cryriver_bulk_request_duration_seconds",
+		"Time taken by bulk requests, by result: ok, failed, rejected or error.",
+		ExponentialBuckets(0.005, 2, 12), "result")
+	BulkBytes = NewHistogram("cryriver_bulk_request_bytes",
+		"Size of bulk requests before compression.", ExponentialBuckets(1024, 4, 9))
+	BulkItemFailures = NewCounter("cryriver_bulk_item_failures_total",
+		"Bulk items that failed, by the error type reported by elasticsearch.", "reason")
+	BulkRetries = NewCounter("cryriver_bulk_retries_total",
+		"Bulk items sent again after elasticsearch rejected them.")
+	BulkRejections = NewCounter("cryriver_bulk_rejections_total",
+		"Bulk requests with items rejected by elasticsearch for being too busy.")
+	BulkRequestsAllowed = NewGauge("cryriver_bulk_requests_allowed",
+		"Simultaneous bulk requests currently allowed.")
+	BulkMaxBytesAllowed = NewGauge("cryriver_bulk_max_bytes",
+		"Size bulk requests may currently grow to.")
+	SlurperCount = NewGauge("cryriver_slurpers",
+		"Running slurpers.")
+	QueueDepth = NewGauge("cryriver_queue_depth",
+		"Operations waiting in a queue: mongoc between the tailer and the dispatcher, esc between the dispatcher and the slurpers.", "queue")
 )
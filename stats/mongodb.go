@@ -8,4 +8,20 @@ var (
 	Unsets   = expvar.NewInt("Total $unset")
 	Sets     = expvar.NewInt("Total $set")
 	Complete = expvar.NewInt("Total complete objects")
+
+	// What the tailer is doing: initial import or tailing
+	Phase = expvar.NewString("phase")
+)
+
+// Prometheus metrics, see Handler.
+var (
+	Operations = NewCounter("cryriver_oplog_operations_total",
+		"Operations read from MongoDB, by namespace and type: insert, update, delete or command. The initial import counts as inserts.",
+		"namespace", "op")
+	LagSeconds = NewGauge("cryriver_lag_seconds",
+		"How far what elasticsearch acknowledged is behind the primary, NaN until measured.")
+	LagOperations = NewGauge("cryriver_lag_operations",
+		"Operations on the namespace after what elasticsearch acknowledged, counted up to 10000 or one past max-lag-ops, NaN until measured.")
+	CheckpointAge = NewGauge("cryriver_checkpoint_age_seconds",
+		"Age of the oplog timestamp last saved as progress, NaN during an initial import.")
 )
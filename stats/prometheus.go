@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Metrics are kept apart from the default Prometheus registry, along with the Go runtime and process
+// metrics.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Counter is a value that only goes up, for each combination of label values.
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)}
+	registry.MustRegister(c.vec)
+	// Metrics without labels are written before being used.
+	if len(labels) == 0 {
+		c.vec.WithLabelValues()
+	}
+	return c
+}
+
+// Add increases the counter for the label values by n.
+func (c *Counter) Add(n float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(n)
+}
+
+// Inc increases the counter for the label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that can go up and down, for each combination of label values. A value can
+// also be computed when the metrics are gathered, see Func.
+type Gauge struct {
+	vec  *prometheus.GaugeVec
+	desc *prometheus.Desc
+
+	mu    sync.Mutex
+	funcs map[string]gaugeFunc
+}
+
+type gaugeFunc struct {
+	values []string
+	f      func() float64
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		vec:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels),
+		desc:  prometheus.NewDesc(name, help, labels, nil),
+		funcs: make(map[string]gaugeFunc),
+	}
+	registry.MustRegister(g)
+	if len(labels) == 0 {
+		g.vec.WithLabelValues()
+	}
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.funcs, strings.Join(values, "\xff"))
+	g.vec.WithLabelValues(values...).Set(v)
+}
+
+// Func makes the gauge for the label values call f for its value every time it's gathered.
+func (g *Gauge) Func(f func() float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.vec.DeleteLabelValues(values...)
+	g.funcs[strings.Join(values, "\xff")] = gaugeFunc{append([]string(nil), values...), f}
+}
+
+// Describe implements prometheus.Collector.
+func (g *Gauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector, with the values that are set and the ones of the funcs.
+func (g *Gauge) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.vec.Collect(ch)
+	for _, s := range g.funcs {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, s.f(), s.values...)
+	}
+}
+
+// Histogram counts observations in buckets, for each combination of label values.
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets in ascending order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)}
+	registry.MustRegister(h.vec)
+	if len(labels) == 0 {
+		h.vec.WithLabelValues()
+	}
+	return h
+}
+
+// ExponentialBuckets returns n buckets starting at start, each factor times larger than the last.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	return prometheus.ExponentialBuckets(start, factor, n)
+}
+
+// Observe adds v to the histogram for the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(v)
+}
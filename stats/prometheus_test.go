@@ -0,0 +1,53 @@
+package stats
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Metrics can only be registered once, even when the tests run again.
+var (
+	testCounter   = NewCounter("test_operations_total", "Operations.", "namespace", "op")
+	testRetries   = NewCounter("test_retries_total", "Retries.")
+	testGauge     = NewGauge("test_queue_depth", "Queued.", "queue")
+	testHistogram = NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "result")
+)
+
+func TestHandler(t *testing.T) {
+	testCounter.vec.Reset()
+	testCounter.Inc("api.users", "update")
+	testCounter.Add(2, "api.users", "insert")
+	testCounter.Inc("api.users", "update")
+	testGauge.Set(3, "esc")
+	testGauge.Func(func() float64 { return math.NaN() }, `mongo"c`)
+	testHistogram.vec.Reset()
+	testHistogram.Observe(0.05, "ok")
+	testHistogram.Observe(0.5, "ok")
+	testHistogram.Observe(5, "ok")
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+	body := string(b)
+
+	for _, expected := range []string{
+		"# HELP test_operations_total Operations.\n# TYPE test_operations_total counter\n" +
+			`test_operations_total{namespace="api.users",op="insert"} 2` + "\n" +
+			`test_operations_total{namespace="api.users",op="update"} 2` + "\n",
+		"# TYPE test_retries_total counter\ntest_retries_total 0\n",
+		`test_queue_depth{queue="esc"} 3` + "\n",
+		`test_queue_depth{queue="mongo\"c"} NaN` + "\n",
+		`test_duration_seconds_bucket{result="ok",le="0.1"} 1` + "\n" +
+			`test_duration_seconds_bucket{result="ok",le="1"} 2` + "\n" +
+			`test_duration_seconds_bucket{result="ok",le="+Inf"} 3` + "\n" +
+			`test_duration_seconds_sum{result="ok"} 5.55` + "\n" +
+			`test_duration_seconds_count{result="ok"} 3` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain:\n%s\ngot:\n%s", expected, body)
+		}
+	}
+}
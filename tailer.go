@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/duego/cryriver/mongodb"
+	"github.com/duego/cryriver/stats"
+	"labix.org/v2/mgo"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ShuttingDown is returned for requests that can't be handled since the river is stopping.
+var ShuttingDown = errors.New("Shutting down")
+
+// TailStopped is returned when restarting a tailer that has stopped on its own.
+var TailStopped = errors.New("Tailing has stopped")
+
+// Importing is returned when rewinding during an initial import, which would leave the documents not
+// imported yet out of elasticsearch.
+var Importing = errors.New("Can't rewind during an initial import")
+
+// tailer runs Tail and restarts it from another position when asked to, without restarting the
+// process. Operations of all runs are handed over on the same channel, which is closed once Tail
+// returns on its own or ctx is done.
+type tailer struct {
+	session  *mgo.Session
+	ns       string
+	pause    *pauser
+	logger   *slog.Logger
+	restarts chan restart
+	done     chan bool // Closed when run returns
+}
+
+// restart asks the tailer to tail from after ts, dropping the first skip operations.
+type restart struct {
+	ts   mongodb.Timestamp
+	skip int
+	done chan bool
+}
+
+func newTailer(session *mgo.Session, ns string, pause *pauser, logger *slog.Logger) *tailer {
+	return &tailer{
+		session:  session,
+		ns:       ns,
+		pause:    pause,
+		logger:   logger.With("namespace", ns),
+		restarts: make(chan restart),
+		done:     make(chan bool),
+	}
+}
+
+// Restart stops the running Tail and starts tailing from after ts, skipping the first skip
+// operations. Operations read but not handed over yet are dropped. Returns once the old Tail has
+// stopped, so that nothing it read is handed over afterwards, with the error of ctx if it's done
+// before the tailer takes the request, or with TailStopped if the tailer has already returned.
+func (t *tailer) Restart(ctx context.Context, ts mongodb.Timestamp, skip int) error {
+	r := restart{ts, skip, make(chan bool)}
+	select {
+	case t.restarts <- r:
+	case <-t.done:
+		return TailStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-r.done
+	return nil
+}
+
+// run tails from after lastTs, or does an initial import first, until ctx is done or Tail returns on
+// its own. Returns the error of the last Tail.
+func (t *tailer) run(ctx context.Context, initial bool, lastTs *mongodb.Timestamp, opc chan<- *mongodb.Operation) error {
+	defer close(t.done)
+	defer close(opc)
+	var skip int
+	for {
+		runc := make(chan *mongodb.Operation)
+		runCtx, stop := context.WithCancel(ctx)
+		errc := make(chan error, 1)
+		go func(initial bool, lastTs *mongodb.Timestamp) {
+			errc <- mongodb.Tail(runCtx, t.session.Copy(), t.ns, initial, lastTs, runc, t.logger)
+		}(initial, lastTs)
+		// Stops Tail, dropping anything it sends meanwhile.
+		stopRun := func(pending *mongodb.Operation) error {
+			if pending != nil {
+				pending.Done(nil)
+			}
+			stop()
+			for op := range runc {
+				op.Done(nil)
+			}
+			return <-errc
+		}
+
+		// The operation to hand over next is held while paused.
+		var pending *mongodb.Operation
+		var r restart
+	forward:
+		for {
+			in, out, resumed := runc, chan<- *mongodb.Operation(nil), (<-chan bool)(nil)
+			if pending != nil {
+				in, resumed = nil, t.pause.Resumed()
+				select {
+				case <-resumed:
+					out, resumed = opc, nil
+				default:
+				}
+			}
+			select {
+			case op, ok := <-in:
+				if !ok {
+					stop()
+					return <-errc
+				}
+				if skip > 0 {
+					skip--
+					id, _ := op.ObjectId()
+					t.logger.Warn("Skipping operation", "ts", op.Timestamp, "_id", id.Hex(), "left", skip)
+					op.Done(errors.New("Skipped"))
+					continue
+				}
+				pending = op
+			case out <- pending:
+				pending = nil
+			case <-resumed:
+			case r = <-t.restarts:
+				break forward
+			case <-ctx.Done():
+				return stopRun(pending)
+			}
+		}
+
+		if err := stopRun(pending); err != nil {
+			t.logger.Error("MongoDB tail failed while restarting", "err", err)
+		}
+		t.logger.Warn("Restarting tail", "ts", r.ts, "skip", r.skip)
+		ts := r.ts
+		initial, lastTs, skip = false, &ts, r.skip
+		close(r.done)
+	}
+}
+
+// rewind asks the dispatcher to tail from another position, see tailer.Restart.
+type rewind struct {
+	ts   mongodb.Timestamp // Zero for after the last dispatched operation
+	skip int
+	done chan error
+}
+
+// apply restarts tailing and saves the new position as progress. Called by the dispatcher between
+// operations, so that nothing read from the old position is dispatched afterwards.
+func (r rewind) apply(ctx context.Context, t *tailer) error {
+	if stats.Phase.Value() == "initial import" {
+		return Importing
+	}
+	ts := r.ts
+	if ts == 0 {
+		if ts = mongodb.Timestamp(atomic.LoadInt64(&lastDispatched)); ts == 0 {
+			ts = mongodb.Timestamp(atomic.LoadInt64(&lastSaved))
+		}
+		if ts == 0 {
+			return errors.New("No operation has been read to skip from, give a timestamp")
+		}
+	}
+	if err := t.Restart(ctx, ts, r.skip); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&lastDispatched, int64(ts))
+	progress.reset(ts)
+	_, err := checkpoint(ctx)
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"github.com/duego/cryriver/stats"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestTailerRestartStopped(t *testing.T) {
+	tail := newTailer(nil, "test.users", newPauser(), slog.Default())
+	close(tail.done)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tail.Restart(ctx, 1, 0); err != TailStopped {
+		t.Error("Expected restarting a stopped tailer to fail right away, got", err)
+	}
+}
+
+func TestRewindImporting(t *testing.T) {
+	defer stats.Phase.Set(stats.Phase.Value())
+	stats.Phase.Set("initial import")
+	// Restarting would block, the tailer isn't running.
+	tail := newTailer(nil, "test.users", newPauser(), slog.Default())
+	for _, r := range []rewind{{ts: 5}, {skip: 1}} {
+		if err := r.apply(context.Background(), tail); err != Importing {
+			t.Error(r, "expected to be refused during an initial import, got", err)
+		}
+	}
+}
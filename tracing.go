@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing exports spans to target, an OTLP/HTTP endpoint such as http://localhost:4318 or
+// stdout, sampling ratio of the operations. Nothing is traced if target is empty. The returned
+// function flushes the spans that haven't been exported yet and must be called before exiting.
+func startTracing(target string, ratio float64) (func(context.Context) error, error) {
+	if target == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	if target == "stdout" {
+		exporter, err = stdouttrace.New()
+	} else {
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(target))
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "cryriver"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/duego/cryriver/mongodb"
+	"sync"
+)
+
+// watermark follows the operations handed to the slurpers, in the order they were read, and tells
+// the timestamp up to which elasticsearch has acknowledged all of them. Nothing before it has to be
+// read again after a restart.
+type watermark struct {
+	mu      sync.Mutex
+	pending []*pendingOp
+	acked   mongodb.Timestamp
+
+	// Set when elasticsearch didn't write an operation.
+	failed bool
+}
+
+// pendingOp is one operation read from the oplog, sent as left entries that aren't acknowledged yet.
+type pendingOp struct {
+	w    *watermark
+	ts   mongodb.Timestamp
+	left int
+}
+
+// add starts following an operation sent as n entries and returns what they should acknowledge. An
+// operation sent as nothing is acknowledged right away.
+func (w *watermark) add(ts mongodb.Timestamp, n int) *pendingOp {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p := &pendingOp{w, ts, n}
+	w.pending = append(w.pending, p)
+	w.advance()
+	return p
+}
+
+// Acknowledge is called once for each entry of the operation, err tells why one wasn't written. The
+// operation still counts as done, it is logged by the slurper and wouldn't be written if read again.
+func (p *pendingOp) Acknowledge(err error) {
+	w := p.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Dropped by reset.
+	if p.left <= 0 {
+		return
+	}
+	if err != nil {
+		w.failed = true
+	}
+	p.left--
+	w.advance()
+}
+
+// advance moves the watermark past the operations acknowledged in a row.
+func (w *watermark) advance() {
+	n := 0
+	for ; n < len(w.pending) && w.pending[n].left <= 0; n++ {
+		w.acked = w.pending[n].ts
+	}
+	w.pending = w.pending[n:]
+}
+
+// reset stops following the operations handed over so far and moves the watermark to ts.
+func (w *watermark) reset(ts mongodb.Timestamp) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range w.pending {
+		p.left = 0
+	}
+	w.pending = nil
+	w.acked = ts
+}
+
+// forgetFailures clears the operations elasticsearch didn't write so far, Done only considers the ones
+// acknowledged from now on.
+func (w *watermark) forgetFailures() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = false
+}
+
+// Acked returns the timestamp up to which everything has been acknowledged.
+func (w *watermark) Acked() mongodb.Timestamp {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.acked
+}
+
+// Done reports whether every operation handed over has been acknowledged and written by
+// elasticsearch.
+func (w *watermark) Done() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending) == 0 && !w.failed
+}
+
+// acked is an operation that acknowledges its part of the read operation once sent, see
+// elasticsearch.Acknowledger.
+type acked struct {
+	*mongodb.EsOperation
+	op *pendingOp
+}
+
+func (a acked) Acknowledge(err error) {
+	a.op.Acknowledge(err)
+}
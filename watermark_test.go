@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWatermark(t *testing.T) {
+	w := new(watermark)
+	w.reset(1)
+	first := w.add(2, 2)
+	second := w.add(3, 1)
+	if w.add(4, 0); w.Acked() != 1 {
+		t.Error("Expected nothing to be acknowledged yet, got", w.Acked())
+	}
+
+	second.Acknowledge(nil)
+	if w.Acked() != 1 {
+		t.Error("Expected the watermark to wait for the first operation, got", w.Acked())
+	}
+	first.Acknowledge(nil)
+	if w.Acked() != 1 {
+		t.Error("Expected the watermark to wait for every entry of the first operation, got", w.Acked())
+	}
+	first.Acknowledge(nil)
+	if w.Acked() != 4 || !w.Done() {
+		t.Error("Expected everything to be acknowledged, got", w.Acked(), w.Done())
+	}
+
+	failing := w.add(5, 1)
+	failing.Acknowledge(errors.New("mapper_parsing_exception"))
+	if w.Acked() != 5 || w.Done() {
+		t.Error("Expected a failed operation to be passed but not done, got", w.Acked(), w.Done())
+	}
+
+	w.forgetFailures()
+	if !w.Done() {
+		t.Error("Expected earlier failures to be forgotten")
+	}
+	w.add(6, 1).Acknowledge(errors.New("mapper_parsing_exception"))
+	if w.Done() {
+		t.Error("Expected a failure after forgetting earlier ones to be remembered")
+	}
+}
+
+func TestWatermarkReset(t *testing.T) {
+	w := new(watermark)
+	old := w.add(10, 1)
+	w.reset(5)
+	old.Acknowledge(nil)
+	if w.Acked() != 5 || !w.Done() {
+		t.Error("Expected operations from before the reset to be ignored, got", w.Acked(), w.Done())
+	}
+}